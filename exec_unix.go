@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup はコマンドを新しいプロセスグループで起動するよう設定します。
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessTree はプロセスグループ全体を停止し、子孫のプロセスも止めます。
+func killProcessTree(process *os.Process) error {
+	if err := syscall.Kill(-process.Pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+	return process.Kill()
+}
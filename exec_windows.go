@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup は Windows では何もしません（子孫のプロセスは taskkill /T で停止します）。
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessTree は taskkill /T でプロセスと子孫のプロセスを停止します。
+func killProcessTree(process *os.Process) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(process.Pid)).Run(); err == nil {
+		return nil
+	}
+	return process.Kill()
+}
@@ -2,20 +2,36 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
+	"log/slog"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -37,6 +53,332 @@ type Config struct {
 	KeyFile           string    `json:"keyPath"`
 	JavaScriptInclude []string  `json:"javascript_include"`
 	Log               LogConfig `json:"log"`
+	// ScriptTimeout はスクリプト実行のタイムアウト秒数です（0 の場合は defaultScriptTimeout）。
+	ScriptTimeout int `json:"script_timeout,omitempty"`
+	// ScriptMaxCallStackSize はスクリプトの最大コールスタック数です（0 の場合は無制限）。
+	ScriptMaxCallStackSize int           `json:"script_max_call_stack_size,omitempty"`
+	Storage                StorageConfig `json:"storage"`
+	Upload                 UploadConfig  `json:"upload"`
+	// RestrictScriptReads が true の場合、nyanGetFile / nyanReadFileB64 で読み込めるのは
+	// ベースディレクトリと ScriptReadDirs の配下だけです（デフォルトは制限しない）。
+	RestrictScriptReads bool `json:"restrict_script_reads,omitempty"`
+	// ScriptReadDirs は RestrictScriptReads の場合にベースディレクトリのほかに読み込めるディレクトリです。
+	ScriptReadDirs []string `json:"script_read_dirs,omitempty"`
+	// MaxBodySize は multipart/form-data 以外のリクエストボディの最大バイト数です（0 の場合は defaultMaxBodySize）。
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// ReloadInterval は設定ファイルの更新を確認する間隔（秒）です（0 の場合は SIGHUP のみ）。
+	ReloadInterval int `json:"reload_interval,omitempty"`
+	// ShutdownTimeout は終了時に処理中のリクエストを待つ秒数です（0 の場合は defaultShutdownTimeout）。
+	ShutdownTimeout int           `json:"shutdown_timeout,omitempty"`
+	Metrics         MetricsConfig `json:"metrics"`
+	// CORS は CORS の設定です（省略時は defaultCORSConfig）。
+	CORS      *CORSConfig     `json:"cors,omitempty"`
+	WebSocket WebSocketConfig `json:"websocket"`
+	// HTTPClient はスクリプトから外部へ送る HTTP リクエスト（nyanFetch など）の設定です。
+	HTTPClient HTTPClientConfig `json:"http_client"`
+	// HostExec は nyanHostExec の設定です。
+	HostExec HostExecConfig `json:"host_exec"`
+}
+
+// HostExecConfig は nyanHostExec でホストのコマンドを実行する設定を表します。
+type HostExecConfig struct {
+	// Enabled が false の場合は nyanHostExec を使えません（省略時は true）。
+	Enabled *bool `json:"enabled,omitempty"`
+	// AllowedCommands は実行を許可するコマンドです（空の場合はすべて許可）。
+	// 配列形式の最初の要素と完全に一致した場合だけ実行します。文字列形式は "sh"（Windows は "cmd"）を含める必要があります。
+	AllowedCommands []string `json:"allowed_commands,omitempty"`
+	// Timeout はコマンドのタイムアウト秒数です（0 の場合はスクリプトのタイムアウトだけ）。
+	Timeout int `json:"timeout,omitempty"`
+	// MaxOutputSize は stdout / stderr それぞれの最大バイト数です（0 の場合は defaultHostExecMaxOutputSize）。
+	MaxOutputSize int64 `json:"max_output_size,omitempty"`
+}
+
+// nyanHostExec の出力の上限のデフォルト
+const defaultHostExecMaxOutputSize = 1 << 20
+
+// enabled は nyanHostExec を使えるかを返します。
+func (cfg HostExecConfig) enabled() bool {
+	return cfg.Enabled == nil || *cfg.Enabled
+}
+
+// allows は command（argv の最初の要素）の実行が許可されているかを返します。
+func (cfg HostExecConfig) allows(command string) bool {
+	if len(cfg.AllowedCommands) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedCommands {
+		if command == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// shellCommands は任意のコマンドを実行できるシェルです。
+var shellCommands = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true,
+	"cmd": true, "cmd.exe": true, "powershell": true, "powershell.exe": true, "pwsh": true, "pwsh.exe": true,
+}
+
+// isShellCommand は command がシェルかどうかを返します（/bin/sh のようなパスも含む）。
+func isShellCommand(command string) bool {
+	name := strings.ToLower(strings.TrimSpace(command))
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return shellCommands[name]
+}
+
+// HTTPClientConfig は外部への HTTP リクエストの設定を表します。
+// 直下の項目がデフォルトのクライアントで、profiles にはスクリプトが名前で選ぶクライアントを定義します。
+type HTTPClientConfig struct {
+	HTTPClientProfile
+	// Profiles は名前付きのクライアントです。省略した項目はデフォルトの設定を引き継ぎます。
+	Profiles map[string]HTTPClientProfile `json:"profiles,omitempty"`
+	// FetchAllConcurrency は nyanFetchAll で同時に送信する数の上限です（0 の場合は defaultFetchAllConcurrency）。
+	FetchAllConcurrency int `json:"fetch_all_concurrency,omitempty"`
+}
+
+// fetchAllConcurrency は nyanFetchAll で同時に送信する数の上限を返します。
+func (cfg HTTPClientConfig) fetchAllConcurrency() int {
+	if cfg.FetchAllConcurrency > 0 {
+		return cfg.FetchAllConcurrency
+	}
+	return defaultFetchAllConcurrency
+}
+
+// HTTPClientProfile は 1 つの HTTP クライアントの設定を表します。
+type HTTPClientProfile struct {
+	// Timeout はリクエスト全体のタイムアウト秒数です（0 の場合は defaultHTTPClientTimeout）。
+	Timeout int `json:"timeout,omitempty"`
+	// MaxIdleConns / MaxIdleConnsPerHost は再利用のために保持する接続数の上限です（0 の場合はデフォルト）。
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	// IdleConnTimeout は使われていない接続を閉じるまでの秒数です（0 の場合は 90 秒）。
+	IdleConnTimeout int `json:"idle_conn_timeout,omitempty"`
+	// Proxy はプロキシの URL です。空の場合は環境変数（HTTPS_PROXY など）、"direct" の場合はプロキシを使いません。
+	Proxy string `json:"proxy,omitempty"`
+	// CAFile はシステムの CA に加えて信頼する CA 証明書（PEM）のパスです。
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile / KeyFile はクライアント証明書（mTLS）のパスです。
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// InsecureSkipVerify はサーバー証明書を検証しません（開発用）。
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// MaxResponseSize はレスポンスボディの最大バイト数です（0 の場合は defaultHTTPClientMaxResponseSize）。
+	MaxResponseSize int64 `json:"max_response_size,omitempty"`
+	// Retry は失敗したリクエストを再試行する設定です（省略時は再試行しません）。
+	Retry *RetryConfig `json:"retry,omitempty"`
+	// CircuitBreaker は失敗が続くホストへのリクエストを止める設定です（省略時は使いません）。
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+}
+
+// RetryConfig は外部への HTTP リクエストの再試行の設定を表します。
+// 再試行するのは冪等なメソッド（GET, HEAD, OPTIONS, PUT, DELETE, TRACE）だけです。
+type RetryConfig struct {
+	// MaxAttempts は最初の 1 回を含む最大の試行回数です（0 の場合は 3）。
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff / MaxBackoff は再試行までの待ち時間の初期値と上限のミリ秒です（0 の場合は 200 / 5000）。
+	// 待ち時間は試行ごとに 2 倍になり、その範囲でランダムに決めます。
+	Backoff    int `json:"backoff,omitempty"`
+	MaxBackoff int `json:"max_backoff,omitempty"`
+	// RetryOn は再試行するステータスコードです（空の場合は 502, 503, 504）。接続できない場合は常に再試行します。
+	RetryOn []int `json:"retry_on,omitempty"`
+}
+
+// CircuitBreakerConfig はサーキットブレーカーの設定を表します。
+// 接続の失敗と 5xx が failure_threshold 回続いたホストへのリクエストは open_timeout 秒の間すぐにエラーにし、
+// その後 1 件だけ試して成功すれば元に戻します。
+type CircuitBreakerConfig struct {
+	FailureThreshold int `json:"failure_threshold,omitempty"` // 0 の場合は 5
+	OpenTimeout      int `json:"open_timeout,omitempty"`      // 0 の場合は 30 秒
+}
+
+// HTTP クライアントのデフォルト
+const (
+	defaultHTTPClientTimeout             = 30 * time.Second
+	defaultHTTPClientMaxResponseSize     = 10 << 20
+	defaultHTTPClientMaxIdleConnsPerHost = 10
+	defaultFetchAllConcurrency           = 8
+	httpClientProxyDirect                = "direct"
+
+	defaultRetryMaxAttempts           = 3
+	defaultRetryBackoff               = 200 * time.Millisecond
+	defaultRetryMaxBackoff            = 5 * time.Second
+	defaultCircuitBreakerThreshold    = 5
+	defaultCircuitBreakerOpenDuration = 30 * time.Second
+)
+
+// WebSocketConfig はサーバー側の WebSocket の設定を表します。
+type WebSocketConfig struct {
+	// AllowedOrigins は接続を許可する Origin です（cors の allow_origins と同じ形式）。
+	// 空の場合は同じホストからの接続と Origin ヘッダーのない接続だけを許可します。
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// SendQueueSize は接続ごとの送信待ちメッセージの上限です（0 の場合は defaultWebSocketSendQueueSize）。
+	SendQueueSize int `json:"send_queue_size,omitempty"`
+	// WriteTimeout は 1 メッセージの送信のタイムアウト秒数です（0 の場合は defaultWebSocketWriteTimeout）。
+	WriteTimeout int `json:"write_timeout,omitempty"`
+	// SlowConsumer は送信待ちがいっぱいの場合の動作です。
+	// "drop_oldest"（デフォルト、古いメッセージを捨てる）または "disconnect"（切断する）。
+	SlowConsumer string `json:"slow_consumer,omitempty"`
+	// ping / 読み込みの設定（api.json のエンドポイントの websocket で上書きできます）
+	WebSocketKeepaliveConfig
+}
+
+// WebSocketKeepaliveConfig は WebSocket の死活監視と受信サイズの上限の設定を表します。
+// サーバー側の接続と ws_client の両方で使います。
+type WebSocketKeepaliveConfig struct {
+	// PingInterval は ping を送る間隔の秒数です（0 の場合は defaultWebSocketPingInterval、負の場合は送りません）。
+	PingInterval int `json:"ping_interval,omitempty"`
+	// PongWait は ping を送ってから何も受信しない接続を切断するまでの秒数です（0 の場合は defaultWebSocketPongWait）。
+	PongWait int `json:"pong_wait,omitempty"`
+	// IdleTimeout はメッセージ（ping / pong を除く）を受信しない接続を切断するまでの秒数です（0 の場合は切断しません）。
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+	// MaxMessageSize は受信するメッセージの最大バイト数です（0 の場合は defaultWebSocketMaxMessageSize、負の場合は無制限）。
+	MaxMessageSize int64 `json:"max_message_size,omitempty"`
+}
+
+// WebSocket の送信と死活監視のデフォルト
+const (
+	defaultWebSocketSendQueueSize  = 64
+	defaultWebSocketWriteTimeout   = 10 * time.Second
+	defaultWebSocketPingInterval   = 30 * time.Second
+	defaultWebSocketPongWait       = 60 * time.Second
+	defaultWebSocketMaxMessageSize = 1 << 20
+)
+
+// wsKeepalive は config.json と api.json の設定を合わせた WebSocket の死活監視の設定です。
+type wsKeepalive struct {
+	pingInterval   time.Duration // 0 の場合は ping を送らない
+	pongWait       time.Duration
+	idleTimeout    time.Duration // 0 の場合はメッセージがなくても切断しない
+	maxMessageSize int64         // 0 の場合は無制限
+}
+
+// webSocketKeepalive は config.json の websocket に endpoint の websocket の設定を重ねた死活監視の設定を返します。
+func webSocketKeepalive(global WebSocketConfig, endpoint EndpointConfig) wsKeepalive {
+	cfg := global.WebSocketKeepaliveConfig
+	if override := endpoint.WebSocket; override != nil {
+		if override.PingInterval != 0 {
+			cfg.PingInterval = override.PingInterval
+		}
+		if override.PongWait != 0 {
+			cfg.PongWait = override.PongWait
+		}
+		if override.IdleTimeout != 0 {
+			cfg.IdleTimeout = override.IdleTimeout
+		}
+		if override.MaxMessageSize != 0 {
+			cfg.MaxMessageSize = override.MaxMessageSize
+		}
+	}
+
+	ka := wsKeepalive{
+		pingInterval:   defaultWebSocketPingInterval,
+		pongWait:       defaultWebSocketPongWait,
+		maxMessageSize: defaultWebSocketMaxMessageSize,
+	}
+	if cfg.PingInterval > 0 {
+		ka.pingInterval = time.Duration(cfg.PingInterval) * time.Second
+	} else if cfg.PingInterval < 0 {
+		ka.pingInterval = 0
+	}
+	if cfg.PongWait > 0 {
+		ka.pongWait = time.Duration(cfg.PongWait) * time.Second
+	}
+	if cfg.IdleTimeout > 0 {
+		ka.idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	}
+	if cfg.MaxMessageSize > 0 {
+		ka.maxMessageSize = cfg.MaxMessageSize
+	} else if cfg.MaxMessageSize < 0 {
+		ka.maxMessageSize = 0
+	}
+	return ka
+}
+
+// prepareRead は conn に受信サイズの上限を設定し、ping を送る場合は pong を受信するたびに読み込み期限を延ばします。
+func (ka wsKeepalive) prepareRead(conn *websocket.Conn) {
+	if ka.maxMessageSize > 0 {
+		conn.SetReadLimit(ka.maxMessageSize)
+	}
+	if ka.pingInterval > 0 {
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(ka.pongWait))
+		})
+	}
+}
+
+// extendRead は次のメッセージを待つ前に読み込み期限を設定します。
+// ping を送らない場合は期限を設けません（応答のない相手を検出できないため）。
+func (ka wsKeepalive) extendRead(conn *websocket.Conn) {
+	if ka.pingInterval > 0 {
+		conn.SetReadDeadline(time.Now().Add(ka.pongWait))
+	}
+}
+
+// isTimeoutError は読み込み期限を過ぎたことによるエラーかを返します。
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// slowConsumerDisconnect は送信待ちがいっぱいの接続を切断する設定値です。
+const slowConsumerDisconnect = "disconnect"
+
+// CORSConfig は CORS の設定を表します。
+type CORSConfig struct {
+	// AllowOrigins は許可する Origin です。"*" や "https://*.example.com" のようにワイルドカードを使えます。
+	AllowOrigins     []string `json:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods,omitempty"`
+	AllowHeaders     []string `json:"allow_headers,omitempty"`
+	ExposeHeaders    []string `json:"expose_headers,omitempty"`
+	MaxAge           int      `json:"max_age,omitempty"` // プリフライトの結果をキャッシュする秒数
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+}
+
+// UploadConfig はファイルアップロードの設定を表します。
+type UploadConfig struct {
+	// Dirs は nyanSaveUpload で保存できるディレクトリです。
+	Dirs []string `json:"dirs"`
+	// InlineMaxSize 以下のファイルは Base64 でスクリプトに渡し、超える場合は一時ファイルのパスを渡します。
+	InlineMaxSize int64 `json:"inline_max_size,omitempty"`
+}
+
+// MetricsConfig は Prometheus 形式のメトリクスエンドポイントの設定を表します。
+type MetricsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path,omitempty"` // 省略時は /metrics
+	Port    int    `json:"port,omitempty"` // 0 の場合は API と同じポートで公開
+	// CircuitsPath はサーキットブレーカーの状態を公開するパスです（省略時は /nyan-circuits）。
+	CircuitsPath string `json:"circuits_path,omitempty"`
+}
+
+// routePath はメトリクスを公開するパスを返します。
+func (cfg MetricsConfig) routePath() string {
+	if strings.TrimSpace(cfg.Path) == "" {
+		return "/metrics"
+	}
+	return cfg.Path
+}
+
+// circuitsRoutePath はサーキットブレーカーの状態を公開するパスを返します。
+func (cfg MetricsConfig) circuitsRoutePath() string {
+	if strings.TrimSpace(cfg.CircuitsPath) == "" {
+		return "/nyan-circuits"
+	}
+	return cfg.CircuitsPath
+}
+
+// separatePort は API とは別のポートでメトリクスを公開するかどうかを返します。
+func (cfg MetricsConfig) separatePort(port int) bool {
+	return cfg.Enabled && cfg.Port != 0 && cfg.Port != port
+}
+
+// StorageConfig は nyanSetItem / nyanGetItem のストレージ設定を表します。
+type StorageConfig struct {
+	Type string `json:"type"` // "memory"（デフォルト）または "file"
+	Path string `json:"path"` // type が "file" の場合の保存先
 }
 
 // LogConfig はログ設定を表します。
@@ -47,6 +389,19 @@ type LogConfig struct {
 	MaxAge        int    `json:"MaxAge"`
 	Compress      bool   `json:"Compress"`
 	EnableLogging bool   `json:"EnableLogging"`
+	Format        string `json:"Format"` // "text"（デフォルト）または "json"
+	Level         string `json:"Level"`  // "debug"、"info"（デフォルト）、"warn" または "error"
+	// Stdout が true の場合は EnableLogging でファイルへ出力するときも標準出力へ出力します。
+	Stdout    bool            `json:"Stdout"`
+	AccessLog AccessLogConfig `json:"AccessLog"`
+}
+
+// AccessLogConfig はアクセスログの設定を表します。
+type AccessLogConfig struct {
+	// Filename はアクセスログの出力先です（空の場合はアプリケーションのログと同じファイル）。
+	// ローテーションの設定は LogConfig と同じです。
+	Filename string `json:"Filename"`
+	Format   string `json:"Format"` // "gin"（デフォルト）、"combined" または "json"
 }
 
 // ResponseData はAPIのレスポンスデータを表します。
@@ -64,12 +419,31 @@ type ErrorData struct {
 
 // EndpointConfig はエンドポイントの設定を表します。
 type EndpointConfig struct {
+	Name        string `json:"-"` // api.json のキー（loadAPIConfig で設定）
 	Type        string `json:"type,omitempty"`
 	Script      string `json:"script"`
 	HTML        string `json:"html"`
 	ConnectURL  string `json:"connectURL,omitempty"`
 	Description string `json:"description"`
 	Push        string `json:"push,omitempty"`
+	Timeout     int    `json:"timeout,omitempty"` // スクリプト実行のタイムアウト秒数
+	// MaxUploadSize は multipart/form-data のリクエストボディの最大バイト数です。
+	MaxUploadSize int64 `json:"max_upload_size,omitempty"`
+	// MaxBodySize は multipart/form-data 以外のリクエストボディの最大バイト数です（0 の場合は config.json の max_body_size）。
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// Methods は受け付ける HTTP メソッドです（空の場合はすべて）。
+	Methods []string `json:"methods,omitempty"`
+	// LogLevel はこのエンドポイントのログの最低レベルです（空の場合は config.json の Level）。
+	LogLevel string `json:"log_level,omitempty"`
+	// CORS を指定した場合は config.json の cors の代わりに使います。
+	CORS *CORSConfig `json:"cors,omitempty"`
+	// WSAuth は WebSocket のアップグレード前に実行し、接続を許可するかを判定するスクリプトです。
+	WSAuth string `json:"ws_auth,omitempty"`
+	// OnOpen / OnClose は WebSocket の接続時 / 切断時に実行するスクリプトです。
+	OnOpen  string `json:"on_open,omitempty"`
+	OnClose string `json:"on_close,omitempty"`
+	// WebSocket を指定した場合は config.json の websocket の ping / 読み込みの設定を上書きします（ws_client でも使えます）。
+	WebSocket *WebSocketKeepaliveConfig `json:"websocket,omitempty"`
 }
 
 type APIConfig map[string]EndpointConfig
@@ -82,15 +456,19 @@ type NyanResponse struct {
 }
 
 type ApiData struct {
-	Description string `json:"description"`
-	Push        string `json:"push,omitempty"`
+	Description string   `json:"description"`
+	Push        string   `json:"push,omitempty"`
+	Methods     []string `json:"methods,omitempty"`
 }
 
 type ExecResult struct {
-	Success  bool   `json:"success"`
-	ExitCode int    `json:"exit_code"`
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
+	Success   bool   `json:"success"`
+	ExitCode  int    `json:"exitCode"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	TimedOut  bool   `json:"timedOut"`        // タイムアウトでプロセスを停止した
+	Truncated bool   `json:"truncated"`       // 出力が max_output_size を超えたため切り詰めた
+	Error     string `json:"error,omitempty"` // 起動できなかった場合などのエラー
 }
 
 type JSONRPCResponse struct {
@@ -113,950 +491,4688 @@ type JSONRPCError struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
-// このシステムの設定
-var globalConfig Config
+// このシステムの設定と api.json から取得する設定
+// ホットリロードで差し替えるため、currentConfig / currentAPIConfig で参照します。
+var configState = struct {
+	sync.RWMutex
+	config Config
+	api    APIConfig
+}{}
+
+// 設定ファイルやスクリプトなどの相対パスの基準ディレクトリ（--base-dir、デフォルトは実行ファイルのディレクトリ）
+var baseDir string
 
 // ビルド時に -ldflags "-X main.buildVersion=..." で上書き可能
 var buildVersion = "v0.0.10"
 
-// api.jsonから取得する設定
-var apiConfig APIConfig
-
-// ストレージ
-var storage = make(map[string]string)
+// ストレージ（main で config.json の storage 設定に従って差し替える）
+var storage itemStore = newMemoryStore()
 
-var ginContext *gin.Context
+// 現在のルーター（ホットリロードで差し替える）
+var currentRouter atomic.Pointer[gin.Engine]
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // 必要に応じて、オリジンチェックを行う
-	},
+	CheckOrigin:     checkWebSocketOrigin,
 }
 
+// エンドポイント名ごとの WebSocket 接続
 var wsConnections = struct {
 	sync.RWMutex
-	conns map[string][]*websocket.Conn
+	conns map[string][]*wsConnection
 }{
-	conns: make(map[string][]*websocket.Conn),
+	conns: make(map[string][]*wsConnection),
 }
 
-// main はメイン関数です。
-func main() {
-	// 実行ファイルのディレクトリを取得
-	exePath, err := os.Executable()
-	if err != nil {
-		log.Fatal("Failed to get executable path:", err)
-	}
-	exeDir := filepath.Dir(exePath)
+// wsConnection はサーバーが受け付けた WebSocket の接続です。
+// 送信は send に積み、接続ごとの writeLoop が順に書き込みます（gorilla/websocket は同時に 1 つの書き込みしか扱えない）。
+type wsConnection struct {
+	id       string
+	endpoint string
+	conn     *websocket.Conn
+	identity interface{} // ws_auth スクリプトが返した identity（なければ nil）
+
+	send           chan wsOutbound
+	writeTimeout   time.Duration
+	keepalive      wsKeepalive
+	disconnectSlow bool // 送信待ちがいっぱいの場合に切断する（false の場合は古いメッセージを捨てる）
+	done           chan struct{}
+	closeOnce      sync.Once
+	mu             sync.Mutex // done を閉じた後に send へ積まないよう write と close で保持する
+}
 
-	// システム設定をロード
-	configPath := resolvePath(exeDir, "config.json")
-	config, err := loadConfig(configPath)
-	if err != nil {
-		log.Fatal("Error loading config:", err)
-	}
-	globalConfig = config
+// wsOutbound は送信待ちのメッセージです。
+type wsOutbound struct {
+	messageType int
+	data        []byte
+}
 
-	// ログ設定を初期化
-	if globalConfig.Log.EnableLogging {
-		// ファイルへのログ出力のみ行う
-		initLogger(globalConfig.Log, exeDir)
-		// Gin のログ設定もファイルへのみ出力するようにする
-		logFile := resolvePath(exeDir, globalConfig.Log.Filename)
-		f, err := os.Create(logFile)
-		if err != nil {
-			log.Printf("Failed to create log file: %v", err)
-		} else {
-			gin.DefaultWriter = f
-		}
-	} else {
-		// ログをターミナル（標準出力）のみに出力する
-		log.SetOutput(os.Stdout)
-		gin.DefaultWriter = os.Stdout
-	}
+// 切断済みの接続に送信しようとした場合のエラー
+var errWebSocketClosed = errors.New("websocket connection is closed")
 
-	log.Printf("Binary version: %s", buildVersion)
-	log.Printf("Config version: %s", globalConfig.Version)
+// errResponseTooLarge は外部へのリクエストのレスポンスが max_response_size を超えたことを表します。
+var errResponseTooLarge = errors.New("response body is too large")
 
-	// API設定をロード
-	apiConfigPath := resolvePath(exeDir, "api.json")
-	if err := loadAPIConfig(apiConfigPath); err != nil {
-		log.Fatal("Error loading API configuration:", err)
+// newWSConnection は conn を config.json の websocket の設定で包み、送信用の goroutine を開始します。
+// ping / 読み込みの設定は endpoint の websocket で上書きされます。
+func newWSConnection(endpoint EndpointConfig, conn *websocket.Conn, identity interface{}) *wsConnection {
+	cfg := currentConfig().WebSocket
+	queueSize := cfg.SendQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultWebSocketSendQueueSize
 	}
-
-	if err := startWebSocketClients(exeDir); err != nil {
-		log.Printf("Failed to start WebSocket clients: %v", err)
+	writeTimeout := defaultWebSocketWriteTimeout
+	if cfg.WriteTimeout > 0 {
+		writeTimeout = time.Duration(cfg.WriteTimeout) * time.Second
 	}
+	wc := &wsConnection{
+		id:             newRequestID(),
+		endpoint:       endpoint.Name,
+		conn:           conn,
+		identity:       identity,
+		send:           make(chan wsOutbound, queueSize),
+		writeTimeout:   writeTimeout,
+		keepalive:      webSocketKeepalive(cfg, endpoint),
+		disconnectSlow: strings.TrimSpace(cfg.SlowConsumer) == slowConsumerDisconnect,
+		done:           make(chan struct{}),
+	}
+	wc.keepalive.prepareRead(conn)
+	go wc.writeLoop()
+	return wc
+}
 
-	gin.DisableConsoleColor()
-	r := gin.Default()
-	r.SetTrustedProxies(nil)
-	r.Use(CORSMiddleware())
-	r.StaticFile("/favicon.ico", resolvePath(exeDir, "./html/favicon.ico"))
-	r.Static("/css", resolvePath(exeDir, "./html/css"))
-	r.Static("/images", resolvePath(exeDir, "./html/images"))
-	r.Static("/js", resolvePath(exeDir, "./html/js"))
-
-	r.GET("/nyan", handleNyan)
-	r.POST("/nyan-rpc", handleJSONRPC)
+// write はメッセージを送信待ちに積みます。複数の goroutine から呼び出せます。
+// 送信待ちがいっぱいの場合は設定に従って最も古いメッセージを捨てるか、接続を切断します。
+func (wc *wsConnection) write(messageType int, data []byte) error {
+	message := wsOutbound{messageType: messageType, data: data}
+	for {
+		wc.mu.Lock()
+		if wc.closed() {
+			wc.mu.Unlock()
+			return errWebSocketClosed
+		}
+		select {
+		case wc.send <- message:
+			wc.mu.Unlock()
+			return nil
+		default:
+		}
+		wc.mu.Unlock()
 
-	// 各APIエンドポイントを設定
-	for endpoint := range apiConfig {
-		config := apiConfig[endpoint] // ループ変数をローカル変数にコピー
-		if strings.TrimSpace(config.Type) == apiTypeWSClient {
-			continue
+		if wc.disconnectSlow {
+			addMetric("nyanpui_websocket_slow_consumer_disconnects_total", 1, wc.endpoint)
+			wc.close()
+			return fmt.Errorf("send queue is full, disconnected slow consumer %s", wc.id)
+		}
+		select {
+		case <-wc.send:
+			addMetric("nyanpui_websocket_dropped_messages_total", 1, wc.endpoint)
+		default:
 		}
-		r.Any("/"+endpoint, func(c *gin.Context) {
-			handleAPIRequestOrWebSocket(c, config)
-		})
 	}
+}
 
-	r.Any("/", func(c *gin.Context) {
-		// クエリパラメータ "api" をチェック
-		apiName := c.Query("api")
-		if apiName != "" {
-			if config, ok := apiConfig[apiName]; ok {
-				handleAPIRequestOrWebSocket(c, config)
+// writeLoop は送信待ちのメッセージと定期的な ping を書き込みます。書き込みに失敗した接続は閉じて一覧から外します。
+func (wc *wsConnection) writeLoop() {
+	var ping <-chan time.Time
+	if wc.keepalive.pingInterval > 0 {
+		ticker := time.NewTicker(wc.keepalive.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case <-wc.done:
+			return
+		case <-ping:
+			if err := wc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wc.writeTimeout)); err != nil {
+				if wc.closed() {
+					return
+				}
+				slog.Warn("Failed to send WebSocket ping, closing connection",
+					"endpoint", wc.endpoint, "connection_id", wc.id, "error", err)
+				wc.close()
 				return
-			} else {
-				c.JSON(http.StatusNotFound, gin.H{"error": "API not found"})
+			}
+		case message := <-wc.send:
+			wc.conn.SetWriteDeadline(time.Now().Add(wc.writeTimeout))
+			if err := wc.conn.WriteMessage(message.messageType, message.data); err != nil {
+				if wc.closed() {
+					return
+				}
+				slog.Warn("Failed to write WebSocket message, closing connection",
+					"endpoint", wc.endpoint, "connection_id", wc.id, "error", err)
+				wc.close()
 				return
 			}
 		}
-		// "api" パラメータがなければ、デフォルトで "html" を使用
-		handleAPIRequestOrWebSocket(c, apiConfig["html"])
+	}
+}
+
+// closeIdle は close フレームを送ってから接続を閉じます。idle_timeout を過ぎた接続に使います。
+func (wc *wsConnection) closeIdle() {
+	wc.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"),
+		time.Now().Add(wc.writeTimeout))
+	wc.close()
+}
+
+// closed は接続が閉じられているかを返します。
+func (wc *wsConnection) closed() bool {
+	select {
+	case <-wc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close は接続を閉じて wsConnections から外します。何度呼び出しても安全です。
+func (wc *wsConnection) close() {
+	wc.closeOnce.Do(func() {
+		wc.mu.Lock()
+		close(wc.done)
+		wc.mu.Unlock()
+		wsConnections.Lock()
+		conns := wsConnections.conns[wc.endpoint]
+		for i, other := range conns {
+			if other == wc {
+				wsConnections.conns[wc.endpoint] = append(conns[:i:i], conns[i+1:]...)
+				break
+			}
+		}
+		wsConnections.Unlock()
+		wc.conn.Close()
 	})
+}
 
-	// HTTPSサーバーを起動するかどうかを判断
-	certFile := resolvePath(exeDir, globalConfig.CertFile)
-	keyFile := resolvePath(exeDir, globalConfig.KeyFile)
-	if globalConfig.CertFile != "" && globalConfig.KeyFile != "" {
-		log.Printf("Starting HTTPS server at %d", globalConfig.Port)
-		err = r.RunTLS(fmt.Sprintf(":%d", globalConfig.Port), certFile, keyFile)
+// webSocketConnections は endpoint の WebSocket 接続の一覧（コピー）を返します。
+func webSocketConnections(endpoint string) []*wsConnection {
+	wsConnections.RLock()
+	defer wsConnections.RUnlock()
+	return append([]*wsConnection(nil), wsConnections.conns[endpoint]...)
+}
+
+// cliOptions はコマンドライン引数を表します。
+// 各オプションは環境変数（NYANPUI_*）でも指定でき、コマンドライン引数が優先されます。
+type cliOptions struct {
+	command    string // "serve"（デフォルト）または "validate"
+	strict     bool   // 警告もエラーとして扱う
+	configPath string // config.json のパス
+	apiPath    string // api.json のパス
+	baseDir    string // 相対パスの基準ディレクトリ（デフォルトは実行ファイルのディレクトリ）
+	port       int    // config.json の port を上書き（0 の場合は上書きしない）
+	certFile   string // config.json の certPath を上書き
+	keyFile    string // config.json の keyPath を上書き
+}
+
+// parseCommandLine はコマンドライン引数と環境変数を解析します。
+func parseCommandLine(args []string) (cliOptions, error) {
+	opts := cliOptions{command: "serve"}
+	if len(args) > 0 && args[0] == "validate" {
+		opts.command = "validate"
+		args = args[1:]
+	}
+
+	envPort := 0
+	if raw := os.Getenv("NYANPUI_PORT"); raw != "" {
+		port, err := strconv.Atoi(raw)
 		if err != nil {
-			log.Fatal("Failed to start HTTPS server:", err)
+			return opts, fmt.Errorf("invalid NYANPUI_PORT: %s", raw)
 		}
-	} else {
-		log.Printf("Starting HTTP server at %d", globalConfig.Port)
-		err = r.Run(fmt.Sprintf(":%d", globalConfig.Port))
+		envPort = port
+	}
+	envStrict := false
+	if raw := os.Getenv("NYANPUI_STRICT"); raw != "" {
+		strict, err := strconv.ParseBool(raw)
 		if err != nil {
-			log.Fatal("Failed to start HTTP server:", err)
+			return opts, fmt.Errorf("invalid NYANPUI_STRICT: %s", raw)
 		}
+		envStrict = strict
 	}
-}
 
-// resolvePath は絶対パスを返すユーティリティ関数です。
-func resolvePath(baseDir, path string) string {
-	if filepath.IsAbs(path) {
-		return path
+	flags := flag.NewFlagSet("NyanPUI", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: NyanPUI [validate] [options]\n")
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&opts.strict, "strict", envStrict, "treat validation warnings as errors and refuse to start on any problem (NYANPUI_STRICT)")
+	flags.StringVar(&opts.configPath, "config", os.Getenv("NYANPUI_CONFIG"), "path to config.json (NYANPUI_CONFIG, default <base-dir>/config.json)")
+	flags.StringVar(&opts.apiPath, "api", os.Getenv("NYANPUI_API"), "path to api.json (NYANPUI_API, default <base-dir>/api.json)")
+	flags.StringVar(&opts.baseDir, "base-dir", os.Getenv("NYANPUI_BASE_DIR"), "base directory for relative paths (NYANPUI_BASE_DIR, default the executable's directory)")
+	flags.IntVar(&opts.port, "port", envPort, "override the port in config.json (NYANPUI_PORT)")
+	flags.StringVar(&opts.certFile, "cert", os.Getenv("NYANPUI_CERT"), "override certPath in config.json (NYANPUI_CERT)")
+	flags.StringVar(&opts.keyFile, "key", os.Getenv("NYANPUI_KEY"), "override keyPath in config.json (NYANPUI_KEY)")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments: %v", flags.Args())
 	}
-	return filepath.Join(baseDir, path)
-}
-
-// loadConfig は設定ファイルを読み込みます。
-func loadConfig(filename string) (Config, error) {
-	var config Config
 
-	// 設定ファイルを読み込む
-	data, err := os.ReadFile(filename)
+	// ベースディレクトリ（未指定なら実行ファイルのディレクトリ）
+	// go run のように実行ファイルの隣に config.json が無い場合はカレントディレクトリを使う
+	if opts.baseDir == "" {
+		exePath, err := os.Executable()
+		if err != nil {
+			return opts, fmt.Errorf("failed to get executable path: %w", err)
+		}
+		opts.baseDir = filepath.Dir(exePath)
+		if _, err := os.Stat(resolvePath(opts.baseDir, "config.json")); err != nil {
+			if wd, err := os.Getwd(); err == nil {
+				opts.baseDir = wd
+			}
+		}
+	}
+	absBaseDir, err := filepath.Abs(opts.baseDir)
 	if err != nil {
-		return config, err
+		return opts, err
 	}
+	opts.baseDir = absBaseDir
 
-	// 設定ファイルの内容をConfig構造体にパースする
-	if err := json.Unmarshal(data, &config); err != nil {
-		return config, err
+	// 設定ファイルのパスは、指定されていればカレントディレクトリから、なければベースディレクトリから解決する
+	for _, path := range []*string{&opts.configPath, &opts.apiPath} {
+		if *path == "" {
+			continue
+		}
+		if *path, err = filepath.Abs(*path); err != nil {
+			return opts, err
+		}
 	}
-	return config, nil
+	if opts.configPath == "" {
+		opts.configPath = resolvePath(opts.baseDir, "config.json")
+	}
+	if opts.apiPath == "" {
+		opts.apiPath = resolvePath(opts.baseDir, "api.json")
+	}
+	return opts, nil
 }
 
-// apiの設定を読み込みます。
-func loadAPIConfig(filePath string) error {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return err
+// applyOverrides はコマンドライン引数で指定された値で設定を上書きします。
+func (opts cliOptions) applyOverrides(config *Config) {
+	if opts.port > 0 {
+		config.Port = opts.port
 	}
-	if err := json.Unmarshal(data, &apiConfig); err != nil {
-		return err
+	if opts.certFile != "" {
+		config.CertFile = opts.certFile
+	}
+	if opts.keyFile != "" {
+		config.KeyFile = opts.keyFile
 	}
-	return nil
 }
 
-// handleAPIRequestOrWebSocket はAPIリクエストまたはWebSocketリクエストを処理します。
-func handleAPIRequestOrWebSocket(c *gin.Context, config EndpointConfig) {
-	if websocket.IsWebSocketUpgrade(c.Request) {
-		handleWebSocket(c, config)
-	} else {
-		handleAPIRequest(c, config)
+// loadConfigWithOverrides は config.json を読み込み、コマンドライン引数の上書きを適用します。
+func loadConfigWithOverrides(opts cliOptions) (Config, error) {
+	config, err := loadConfig(opts.configPath)
+	if err != nil {
+		return config, err
 	}
+	opts.applyOverrides(&config)
+	return config, nil
 }
 
-// handleAPIRequest はAPIリクエストを処理します。
-func handleAPIRequest(c *gin.Context, config EndpointConfig) {
-	// HTTP/2サーバープッシュの処理は削除
+// main はメイン関数です。
+func main() {
+	opts, err := parseCommandLine(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	baseDir = opts.baseDir
 
-	// 実行ファイルのディレクトリを取得
-	exePath, err := os.Executable()
+	// システム設定をロード
+	config, err := loadConfigWithOverrides(opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get executable path"})
+		log.Fatal("Error loading config:", err)
+	}
+
+	// validate サブコマンドは設定を検証して終了する
+	if opts.command == "validate" {
+		api, err := loadAPIConfig(opts.apiPath)
+		if err != nil {
+			fmt.Printf("ERROR api.json: %v\n", err)
+			os.Exit(1)
+		}
+		report := validateConfigs(baseDir, config, api)
+		// ルートの競合は gin への登録で検出する
+		gin.SetMode(gin.ReleaseMode)
+		if _, err := newRouter(baseDir, config, api); err != nil {
+			report.errorf("api.json", "%v", err)
+		}
+		report.print(os.Stdout)
+		if report.failed(opts.strict) {
+			os.Exit(1)
+		}
 		return
 	}
-	exeDir := filepath.Dir(exePath)
 
-	ginContext = c
-	defer func() { ginContext = nil }()
+	// ログ設定を初期化
+	if err := initLogger(config.Log, baseDir); err != nil {
+		log.Fatal("Error initializing logger:", err)
+	}
 
-	// リクエストのコンテンツタイプを取得
-	contentType := c.ContentType()
+	slog.Info("Starting NyanPUI", "binary_version", buildVersion, "config_version", config.Version)
 
-	// リクエストパラメータの収集
-	allParams := make(map[string]interface{})
-	if contentType == "application/json" {
-		var requestData map[string]interface{}
-		if err := c.BindJSON(&requestData); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
-			return
-		}
-		for k, v := range requestData {
-			allParams[k] = v
-		}
+	// ストレージを初期化
+	store, err := openItemStore(config.Storage, baseDir)
+	if err != nil {
+		exitWithError("Error opening storage", err)
 	}
+	storage = store
 
-	// URLクエリパラメータとPOSTフォームパラメータを追加
-	c.Request.ParseForm()
-	for k, v := range c.Request.PostForm {
-		allParams[k] = v[0]
+	// API設定をロード
+	slog.Info("Base directory", "path", baseDir)
+	api, err := loadAPIConfig(opts.apiPath)
+	if err != nil {
+		exitWithError("Error loading API configuration", err)
 	}
-	for k, v := range c.Request.URL.Query() {
-		allParams[k] = v[0]
+
+	// 設定を検証（問題はログに出力し、--strict の場合だけ起動しない）
+	report := validateConfigs(baseDir, config, api)
+	report.log()
+	if opts.strict && report.failed(true) {
+		exitWithError("Configuration validation failed", nil)
 	}
+	setCurrentConfigs(config, api)
 
-	if allParams["api"] == nil {
-		if c.Request.URL.Path != "/" {
-			allParams["api"] = c.Request.URL.Path
-		} else {
-			allParams["api"] = "html"
-		}
+	clients, err := newHTTPClients(baseDir, config.HTTPClient)
+	if err != nil {
+		exitWithError("Error creating HTTP clients", err)
 	}
+	setHTTPClients(clients)
 
-	// スクリプトとHTMLファイルのパスを取得
-	scriptPath := resolvePath(exeDir, config.Script)
-	htmlPath := ""
-	if strings.TrimSpace(config.HTML) != "" {
-		htmlPath = resolvePath(exeDir, config.HTML)
+	if err := syncWebSocketClients(api); err != nil {
+		slog.Error("Failed to start WebSocket clients", "error", err)
 	}
 
-	// scriptが空の場合、HTMLファイルの内容をそのまま返す
-	if config.Script == "" {
-		htmlContent, err := os.ReadFile(htmlPath)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load HTML file"})
-			return
+	gin.DisableConsoleColor()
+	r, err := newRouter(baseDir, config, api)
+	if err != nil {
+		exitWithError("Error creating router", err)
+	}
+	currentRouter.Store(r)
+
+	// 設定ファイルの変更（SIGHUP または定期チェック）で再読み込みする
+	go watchConfigFiles(opts)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: http.HandlerFunc(serveCurrentRouter),
+	}
+
+	// メトリクスを別ポートで公開する場合は専用のサーバーを起動する
+	var metricsServer *http.Server
+	if config.Metrics.separatePort(config.Port) {
+		mux := http.NewServeMux()
+		mux.HandleFunc(config.Metrics.routePath(), serveMetrics)
+		if config.Metrics.circuitsRoutePath() != config.Metrics.routePath() {
+			mux.HandleFunc(config.Metrics.circuitsRoutePath(), serveCircuitBreakers)
 		}
-		c.Data(http.StatusOK, "text/html; charset=utf-8", htmlContent)
-		return
+		metricsServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", config.Metrics.Port),
+			Handler: mux,
+		}
+		go func() {
+			slog.Info("Starting metrics server", "port", config.Metrics.Port)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Failed to start metrics server", "error", err)
+			}
+		}()
+	}
+
+	// HTTPSサーバーを起動するかどうかを判断
+	certFile := resolvePath(baseDir, config.CertFile)
+	keyFile := resolvePath(baseDir, config.KeyFile)
+	serverErr := make(chan error, 1)
+	go func() {
+		if config.CertFile != "" && config.KeyFile != "" {
+			slog.Info("Starting HTTPS server", "port", config.Port)
+			serverErr <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			slog.Info("Starting HTTP server", "port", config.Port)
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	// SIGINT / SIGTERM で処理中のリクエストを待ってから終了する
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		exitWithError("Failed to start server", err)
+	case sig := <-quit:
+		slog.Info("Shutting down", "signal", sig.String())
 	}
+	shutdown(server, metricsServer)
+}
+
+// 終了時に処理中のリクエストを待つ時間のデフォルト
+const defaultShutdownTimeout = 30 * time.Second
 
-	// JavaScriptを実行し、結果を取得
-	resultValue, err := runJavaScriptValue(scriptPath, htmlPath, allParams)
+// exitWithError はエラーをログに出力して終了します。
+// ログの初期化後は log.Fatal を使わないでください（slog 経由の INFO になり、log.Level によっては出力されません）。
+func exitWithError(msg string, err error) {
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		slog.Error(msg, "error", err)
+	} else {
+		slog.Error(msg)
 	}
+	closeLogger()
+	os.Exit(1)
+}
 
-	if handled, err := writeJSResponse(c, resultValue); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	} else if handled {
-		return
+// shutdown は新しい接続の受け付けを止め、処理中のリクエスト・WebSocket・ws_client を終了させます。
+// metricsServer はメトリクスを別ポートで公開していない場合は nil です。
+func shutdown(server *http.Server, metricsServer *http.Server) {
+	timeout := defaultShutdownTimeout
+	if seconds := currentConfig().ShutdownTimeout; seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// ws_client の再接続ループを止める
+	stopWebSocketClients()
+
+	// WebSocket は Shutdown の対象外のため、Shutdown と並行して close フレームを送り、
+	// 同じタイムアウトの中で切断を待つ
+	wsClosed := make(chan struct{})
+	server.RegisterOnShutdown(func() {
+		defer close(wsClosed)
+		closeWebSocketConnections(ctx)
+	})
 
-	// HTML出力として結果を返す
-	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(resultValue.String()))
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Graceful shutdown timed out, closing remaining connections", "error", err)
+		server.Close()
+	}
+	<-wsClosed
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
 
-	// push 設定がある場合、対象のWebSocket接続に対してプッシュ
-	// API リクエスト完了後の push 処理
-	performPush(config, allParams)
+	if err := storage.Close(); err != nil {
+		slog.Error("Failed to close storage", "error", err)
+	}
+	slog.Info("Server stopped")
+	closeLogger()
+}
 
+// currentConfig は現在のシステム設定を返します。
+func currentConfig() Config {
+	configState.RLock()
+	defer configState.RUnlock()
+	return configState.config
 }
 
-// handleWebSocket はWebSocketリクエストを処理します。
-func handleWebSocket(c *gin.Context, config EndpointConfig) {
-	endpoint := c.Request.URL.Path[1:] // 例: "/html2" -> "html2"
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("Failed to set websocket upgrade: %v", err)
-		sendHTMLErrorResponse(c.Writer, "WebSocket upgrade failed")
-		return
-	}
-	// 登録処理
-	wsConnections.Lock()
-	wsConnections.conns[endpoint] = append(wsConnections.conns[endpoint], conn)
-	wsConnections.Unlock()
+// currentAPIConfig は現在の api.json の設定を返します。返された map は変更しないでください。
+func currentAPIConfig() APIConfig {
+	configState.RLock()
+	defer configState.RUnlock()
+	return configState.api
+}
 
-	// 接続終了時に削除する
-	defer func() {
-		wsConnections.Lock()
-		conns := wsConnections.conns[endpoint]
-		for i, c := range conns {
-			if c == conn {
-				wsConnections.conns[endpoint] = append(conns[:i], conns[i+1:]...)
-				break
-			}
-		}
-		wsConnections.Unlock()
-		conn.Close()
-	}()
+// setCurrentConfigs は設定を差し替えます。
+func setCurrentConfigs(config Config, api APIConfig) {
+	configState.Lock()
+	defer configState.Unlock()
+	configState.config = config
+	configState.api = api
+}
 
-	for {
-		messageType, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Error reading message: %v", err)
-			sendWebSocketHTMLError(conn, messageType, "Error reading message")
-			break
+// serveCurrentRouter は現在のルーターでリクエストを処理します。
+func serveCurrentRouter(w http.ResponseWriter, r *http.Request) {
+	currentRouter.Load().ServeHTTP(w, r)
+}
+
+// newRouter は api を元にルーターを作成します。
+func newRouter(baseDir string, config Config, api APIConfig) (*gin.Engine, error) {
+	r := gin.New()
+	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Output: accessLogWriter, Formatter: accessLogFormatter}))
+	r.Use(gin.Recovery())
+	r.SetTrustedProxies(nil)
+	r.Use(requestIDMiddleware())
+	r.Use(metricsMiddleware())
+	r.Use(CORSMiddleware(config, api))
+	r.StaticFile("/favicon.ico", resolvePath(baseDir, "./html/favicon.ico"))
+	r.Static("/css", resolvePath(baseDir, "./html/css"))
+	r.Static("/images", resolvePath(baseDir, "./html/images"))
+	r.Static("/js", resolvePath(baseDir, "./html/js"))
+
+	r.GET("/nyan", handleNyan)
+	r.POST("/nyan-rpc", handleJSONRPC)
+	if config.Metrics.Enabled && !config.Metrics.separatePort(config.Port) {
+		r.GET(config.Metrics.routePath(), gin.WrapF(serveMetrics))
+		if config.Metrics.circuitsRoutePath() != config.Metrics.routePath() {
+			r.GET(config.Metrics.circuitsRoutePath(), gin.WrapF(serveCircuitBreakers))
 		}
-		log.Printf("Received message on %s: %s", endpoint, message)
+	}
 
-		// 受信したメッセージを JSON としてパース
-		var req map[string]string
-		if err := json.Unmarshal(message, &req); err != nil {
-			log.Printf("Invalid JSON received: %v", err)
-			// JSON パースに失敗した場合はエコーするか、エラーメッセージを返す
-			conn.WriteMessage(messageType, []byte("Invalid JSON"))
+	// 各APIエンドポイントを設定
+	for endpoint := range api {
+		config := api[endpoint] // ループ変数をローカル変数にコピー
+		if strings.TrimSpace(config.Type) == apiTypeWSClient {
 			continue
 		}
+		if err := registerEndpoint(r, config); err != nil {
+			return nil, err
+		}
+	}
 
-		// "api" キーがあるかチェック
-		if apiName, ok := req["api"]; ok {
-			// apiConfig から対象の設定を取得
-			apiCfg, found := apiConfig[apiName]
-			if !found {
-				errMsg := fmt.Sprintf("API %s not found", apiName)
-				conn.WriteMessage(messageType, []byte(errMsg))
-				continue
+	r.Any("/", func(c *gin.Context) {
+		// クエリパラメータ "api" をチェック
+		apiName := c.Query("api")
+		if apiName != "" {
+			if config, ok := api[apiName]; ok {
+				handleAPIRequestOrWebSocket(c, config)
+				return
+			} else {
+				c.JSON(http.StatusNotFound, gin.H{"error": "API not found"})
+				return
 			}
-			// 例として、スクリプトが空の場合は HTML ファイルの内容を返す実装
-			exePath, err := os.Executable()
-			if err != nil {
-				conn.WriteMessage(messageType, []byte("Server error"))
+		}
+		// "api" パラメータがなければ、デフォルトで "html" を使用
+		handleAPIRequestOrWebSocket(c, api["html"])
+	})
+	return r, nil
+}
+
+// watchConfigFiles は SIGHUP を受け取るか、reload_interval ごとに設定ファイルの更新を検出すると再読み込みします。
+func watchConfigFiles(opts cliOptions) {
+	configPath, apiConfigPath := opts.configPath, opts.apiPath
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	lastConfigMod := fileModTime(configPath)
+	lastAPIMod := fileModTime(apiConfigPath)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var elapsed time.Duration
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("SIGHUP received, reloading configuration")
+		case <-ticker.C:
+			interval := time.Duration(currentConfig().ReloadInterval) * time.Second
+			if interval <= 0 {
 				continue
 			}
-			exeDir := filepath.Dir(exePath)
-			htmlPath := resolvePath(exeDir, apiCfg.HTML)
-			content, err := os.ReadFile(htmlPath)
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to read HTML file for API %s: %v", apiName, err)
-				conn.WriteMessage(messageType, []byte(errMsg))
+			elapsed += time.Second
+			if elapsed < interval {
 				continue
 			}
-			// 取得した内容を返信
-			if err := conn.WriteMessage(websocket.TextMessage, content); err != nil {
-				log.Printf("Error writing message for API %s: %v", apiName, err)
-			}
-		} else {
-			// "api" キーが無い場合はエコーするか、適宜処理を追加
-			if err := conn.WriteMessage(messageType, message); err != nil {
-				log.Printf("Error writing echo message: %v", err)
+			elapsed = 0
+			configMod := fileModTime(configPath)
+			apiMod := fileModTime(apiConfigPath)
+			if configMod.Equal(lastConfigMod) && apiMod.Equal(lastAPIMod) {
+				continue
 			}
+			slog.Info("Configuration file change detected, reloading configuration")
+		}
+		lastConfigMod = fileModTime(configPath)
+		lastAPIMod = fileModTime(apiConfigPath)
+		if err := reloadConfigs(opts); err != nil {
+			slog.Error("Reload failed, keeping the current configuration", "error", err)
 		}
 	}
 }
 
-// sendWebSocketHTMLError はWebSocket接続にHTML形式のエラーメッセージを送信します。
-func sendWebSocketHTMLError(conn *websocket.Conn, messageType int, errorMessage string) {
-	errorHTML := fmt.Sprintf("<html><body><h1>Error</h1><p>%s</p></body></html>", errorMessage)
-	if err := conn.WriteMessage(messageType, []byte(errorHTML)); err != nil {
-		log.Printf("Error writing error message: %v", err)
+// fileModTime はファイルの更新日時を返します。取得できない場合はゼロ値です。
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
 	}
+	return info.ModTime()
 }
 
-// sendHTMLErrorResponse はWebSocketアップグレードの際に発生したエラーをHTMLでクライアントに送信します。
-func sendHTMLErrorResponse(w http.ResponseWriter, errorMessage string) {
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusInternalServerError)
-	errorHTML := fmt.Sprintf("<html><body><h1>Error</h1><p>%s</p></body></html>", errorMessage)
-	w.Write([]byte(errorHTML))
-}
-
-// runJavaScript はJavaScriptを実行します。
-func runJavaScript(scriptPath string, htmlPath string, allParams map[string]interface{}) (string, error) {
-	value, err := runJavaScriptValue(scriptPath, htmlPath, allParams)
+// reloadConfigs は config.json と api.json を読み込み直し、ルーターと ws_client を差し替えます。
+// 読み込みや検証に失敗した場合（--strict の場合は警告があった場合も）は現在の設定のままエラーを返します。
+func reloadConfigs(opts cliOptions) error {
+	config, err := loadConfigWithOverrides(opts)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("config.json: %w", err)
 	}
-	return value.String(), nil
-}
-
-// resolveCurrentAPINameFromContext は現在の HTTP リクエストから API 名を解決します。
-func resolveCurrentAPINameFromContext(c *gin.Context) string {
-	if c == nil || c.Request == nil || c.Request.URL == nil {
-		return ""
+	api, err := loadAPIConfig(opts.apiPath)
+	if err != nil {
+		return fmt.Errorf("api.json: %w", err)
 	}
-
-	if apiName := strings.TrimSpace(c.Query("api")); apiName != "" {
-		return apiName
+	report := validateConfigs(baseDir, config, api)
+	report.log()
+	if report.failed(opts.strict) {
+		return fmt.Errorf("validation failed")
 	}
-
-	path := strings.TrimSpace(c.Request.URL.Path)
-	if path == "" || path == "/" {
-		return "html"
+	r, err := newRouter(baseDir, config, api)
+	if err != nil {
+		return err
 	}
-	return strings.TrimPrefix(path, "/")
-}
-
-// callNyanAPIFromVM は、JavaScript(VM) から api.json 定義の API を内部実行します。
-func callNyanAPIFromVM(apiName string, allParams map[string]interface{}) (interface{}, error) {
-	if strings.TrimSpace(apiName) == "" {
-		return nil, fmt.Errorf("api name is required")
+	clients, err := newHTTPClients(baseDir, config.HTTPClient)
+	if err != nil {
+		return err
 	}
 
-	apiCfg, found := apiConfig[apiName]
-	if !found {
-		return nil, fmt.Errorf("API config not found: %s", apiName)
+	oldConfig := currentConfig()
+	oldAPI := currentAPIConfig()
+	setCurrentConfigs(config, api)
+	currentRouter.Store(r)
+	setHTTPClients(clients)
+
+	logAPIConfigDiff(oldAPI, api)
+	if oldConfig.Port != config.Port || oldConfig.CertFile != config.CertFile || oldConfig.KeyFile != config.KeyFile {
+		slog.Warn("Reload: port and certificate changes take effect after restart")
 	}
-	if strings.TrimSpace(apiCfg.Type) == apiTypeWSClient {
-		return nil, fmt.Errorf("API %s is ws_client and cannot be called by nyanCallMe", apiName)
+	if !reflect.DeepEqual(oldConfig.Log, config.Log) || !reflect.DeepEqual(oldConfig.Storage, config.Storage) {
+		slog.Warn("Reload: log and storage changes take effect after restart")
 	}
-	if strings.TrimSpace(apiCfg.Script) == "" {
-		return nil, fmt.Errorf("script not found for API %s", apiName)
+	if oldConfig.Metrics.separatePort(oldConfig.Port) != config.Metrics.separatePort(config.Port) ||
+		(config.Metrics.separatePort(config.Port) && oldConfig.Metrics != config.Metrics) {
+		slog.Warn("Reload: metrics port changes take effect after restart")
 	}
 
-	params := make(map[string]interface{}, len(allParams)+1)
-	for key, value := range allParams {
-		params[key] = value
+	if err := syncWebSocketClients(api); err != nil {
+		slog.Error("Failed to start WebSocket clients", "error", err)
 	}
-	params["api"] = apiName
+	slog.Info("Configuration reloaded")
+	return nil
+}
 
-	resultValue, err := runJavaScriptValue(apiCfg.Script, apiCfg.HTML, params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to run API %s: %w", apiName, err)
-	}
-	if resultValue == nil || goja.IsUndefined(resultValue) || goja.IsNull(resultValue) {
-		return nil, nil
+// logAPIConfigDiff は追加・削除・変更されたエンドポイントをログに出力します。
+func logAPIConfigDiff(oldAPI, newAPI APIConfig) {
+	var added, removed, changed []string
+	for name, cfg := range newAPI {
+		oldCfg, ok := oldAPI[name]
+		if !ok {
+			added = append(added, name)
+		} else if !reflect.DeepEqual(oldCfg, cfg) {
+			changed = append(changed, name)
+		}
 	}
-
-	exported := resultValue.Export()
-	if asText, ok := exported.(string); ok {
-		var parsed interface{}
-		if json.Unmarshal([]byte(asText), &parsed) == nil {
-			return parsed, nil
+	for name := range oldAPI {
+		if _, ok := newAPI[name]; !ok {
+			removed = append(removed, name)
 		}
 	}
-	return exported, nil
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	slog.Info("Reload: endpoints updated", "added", added, "removed", removed, "changed", changed)
 }
 
-func runJavaScriptValue(scriptPath string, htmlPath string, allParams map[string]interface{}) (goja.Value, error) {
-	// 実行ファイルのディレクトリを取得
-	exePath, err := os.Executable()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get executable path: %v", err)
+// validationIssue は設定の検証で見つかった問題です。
+type validationIssue struct {
+	warning bool
+	target  string // 問題のある設定（"config.json" やエンドポイント名）
+	message string
+}
+
+func (issue validationIssue) String() string {
+	level := "ERROR"
+	if issue.warning {
+		level = "WARN"
 	}
-	exeDir := filepath.Dir(exePath)
+	return fmt.Sprintf("%s %s: %s", level, issue.target, issue.message)
+}
 
-	// スクリプトのパスを解決
-	scriptPath = resolvePath(exeDir, scriptPath)
+// validationReport は設定の検証結果です。
+type validationReport struct {
+	issues []validationIssue
+}
 
-	// goja ランタイムのセットアップ（リクエストごとに新しいランタイムを作る）
-	runtime := setupGojaRuntime()
+func (report *validationReport) errorf(target, format string, args ...interface{}) {
+	report.issues = append(report.issues, validationIssue{target: target, message: fmt.Sprintf(format, args...)})
+}
 
-	// ライブラリの JavaScript ファイルを読み込み
-	var jsLibCode string
-	for _, includePath := range globalConfig.JavaScriptInclude {
-		includePath = resolvePath(exeDir, includePath)
-		code, err := os.ReadFile(includePath)
-		log.Print("Include file:", includePath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read included JS file %s: %v", includePath, err)
+func (report *validationReport) warnf(target, format string, args ...interface{}) {
+	report.issues = append(report.issues, validationIssue{warning: true, target: target, message: fmt.Sprintf(format, args...)})
+}
+
+// failed はエラーがあるかを返します。strict の場合は警告もエラーとして扱います。
+func (report *validationReport) failed(strict bool) bool {
+	for _, issue := range report.issues {
+		if !issue.warning || strict {
+			return true
 		}
-		jsLibCode += string(code) + "\n"
 	}
+	return false
+}
 
-	var htmlJS string
-	if strings.TrimSpace(htmlPath) == "" {
-		htmlJS = "const nyanHtmlCode = \"\";\n"
-	} else {
-		// HTMLファイルを読み込み
-		htmlPath = resolvePath(exeDir, htmlPath)
-		htmlCodeBytes, err := os.ReadFile(htmlPath)
-		if err != nil {
-			log.Printf("Failed to load HTML file at path: %s, error: %v", htmlPath, err)
-			return nil, fmt.Errorf("failed to load HTML file: %v", err)
+// print は検証結果を出力します。
+func (report *validationReport) print(w io.Writer) {
+	errorCount, warningCount := 0, 0
+	for _, issue := range report.issues {
+		fmt.Fprintln(w, issue)
+		if issue.warning {
+			warningCount++
+		} else {
+			errorCount++
 		}
-		escapedHTML := strconv.Quote(string(htmlCodeBytes))
-		htmlJS = fmt.Sprintf("const nyanHtmlCode = %s;\n", escapedHTML)
 	}
+	fmt.Fprintf(w, "%d error(s), %d warning(s)\n", errorCount, warningCount)
+}
 
-	// リクエストパラメータをJSON文字列に変換してJavaScript変数として設定
-	allParamsJSON, err := json.Marshal(allParams)
-	if err != nil {
-		return nil, err
-	}
-	//変数に格納
-	paramsJS := fmt.Sprintf("const nyanAllParams = %s;\n", allParamsJSON)
-	// JavaScriptファイル本体を読み込み
-	jsCodeBytes, err := os.ReadFile(scriptPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read JavaScript file: %v", err)
+// log は検出した問題をレベル付きでログに出力します。
+func (report *validationReport) log() {
+	for _, issue := range report.issues {
+		if issue.warning {
+			slog.Warn("Validation warning", "target", issue.target, "message", issue.message)
+		} else {
+			slog.Error("Validation error", "target", issue.target, "message", issue.message)
+		}
 	}
+}
 
-	// 全体の JavaScript コードを結合
-	fullJSCode := jsLibCode + htmlJS + paramsJS + string(jsCodeBytes)
+// validateConfigs は config.json と api.json の内容を検証します。
+// ファイルの存在、スクリプトのコンパイル、push 先、予約語などを確認します。
+func validateConfigs(baseDir string, config Config, api APIConfig) *validationReport {
+	report := &validationReport{}
 
-	// スクリプトを実行
-	value, err := runtime.RunString(fullJSCode)
-	if err != nil {
-		return nil, err
+	if config.Port <= 0 || config.Port > 65535 {
+		report.errorf("config.json", "port %d is out of range", config.Port)
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		report.errorf("config.json", "certPath and keyPath must be set together")
+	}
+	for _, path := range []string{config.CertFile, config.KeyFile} {
+		if path != "" {
+			checkFileExists(report, "config.json", resolvePath(baseDir, path))
+		}
+	}
+	for _, includePath := range config.JavaScriptInclude {
+		checkScriptCompiles(report, "config.json", resolvePath(baseDir, includePath), false)
+	}
+	switch strings.TrimSpace(config.Storage.Type) {
+	case "", "memory":
+	case "file":
+		if strings.TrimSpace(config.Storage.Path) == "" {
+			report.errorf("config.json", "storage path is required for file storage")
+		}
+	default:
+		report.errorf("config.json", "unknown storage type: %s", config.Storage.Type)
 	}
 
-	return value, nil
-}
-
-func writeJSResponse(c *gin.Context, value goja.Value) (bool, error) {
-	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
-		return false, nil
+	if _, err := parseLogLevel(config.Log.Level); err != nil {
+		report.errorf("config.json", "%v", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(config.Log.Format)) {
+	case "", "text", "json":
+	default:
+		report.errorf("config.json", "unknown log format: %s", config.Log.Format)
+	}
+	if _, err := newAccessLogFormatter(config.Log.AccessLog.Format); err != nil {
+		report.errorf("config.json", "%v", err)
+	}
+	validateCORSConfig(report, "config.json", config.CORS)
+	validateOriginPatterns(report, "config.json", "websocket allowed_origins", config.WebSocket.AllowedOrigins)
+	switch strings.TrimSpace(config.WebSocket.SlowConsumer) {
+	case "", "drop_oldest", slowConsumerDisconnect:
+	default:
+		report.errorf("config.json", "unknown websocket slow_consumer: %s", config.WebSocket.SlowConsumer)
+	}
+	validateWebSocketKeepalive(report, "config.json", config.WebSocket, EndpointConfig{})
+	if _, err := newHTTPClients(baseDir, config.HTTPClient); err != nil {
+		report.errorf("config.json", "%v", err)
+	}
+	if config.HostExec.Timeout < 0 || config.HostExec.MaxOutputSize < 0 {
+		report.errorf("config.json", "host_exec timeout and max_output_size must not be negative")
+	}
+	for _, command := range config.HostExec.AllowedCommands {
+		if strings.TrimSpace(command) == "" {
+			report.errorf("config.json", "host_exec allowed_commands has an empty command")
+		}
+		if isShellCommand(command) {
+			report.warnf("config.json", "host_exec allowed_commands contains the shell %s, which allows any command", command)
+		}
+	}
+	if config.Metrics.Enabled {
+		if !strings.HasPrefix(config.Metrics.routePath(), "/") {
+			report.errorf("config.json", "metrics path must start with /: %s", config.Metrics.Path)
+		}
+		if !strings.HasPrefix(config.Metrics.circuitsRoutePath(), "/") {
+			report.errorf("config.json", "metrics circuits_path must start with /: %s", config.Metrics.CircuitsPath)
+		}
+		if config.Metrics.circuitsRoutePath() == config.Metrics.routePath() {
+			report.errorf("config.json", "metrics circuits_path must differ from path: %s", config.Metrics.routePath())
+		}
+		if config.Metrics.Port < 0 || config.Metrics.Port > 65535 {
+			report.errorf("config.json", "metrics port %d is out of range", config.Metrics.Port)
+		}
 	}
 
-	exported := value.Export()
-	respMap, ok := exported.(map[string]interface{})
-	if !ok {
-		return false, nil
+	names := make([]string, 0, len(api))
+	for name := range api {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	status := http.StatusOK
-	if rawStatus, ok := respMap["status"]; ok {
-		if parsed, ok := parseStatusCode(rawStatus); ok {
-			status = parsed
+	for _, name := range names {
+		cfg := api[name]
+		lowerName := strings.ToLower(name)
+		if strings.HasPrefix(lowerName, "api") || strings.HasPrefix(lowerName, "nyan") {
+			report.warnf(name, "names starting with \"api\" or \"nyan\" are reserved")
 		}
-	}
 
-	contentType := ""
-	if rawContentType, ok := respMap["contentType"]; ok {
-		if s, ok := rawContentType.(string); ok {
-			contentType = s
-		} else {
-			contentType = fmt.Sprint(rawContentType)
+		if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+			report.errorf(name, "%v", err)
+		}
+		validateCORSConfig(report, name, cfg.CORS)
+		if cfg.WebSocket != nil {
+			validateWebSocketKeepalive(report, name, config.WebSocket, cfg)
 		}
-	}
 
-	headers := map[string]string{}
-	if rawHeaders, ok := respMap["headers"]; ok {
-		if headerMap, ok := rawHeaders.(map[string]interface{}); ok {
-			for key, value := range headerMap {
-				headers[key] = fmt.Sprint(value)
+		if strings.TrimSpace(cfg.Type) == apiTypeWSClient {
+			if strings.TrimSpace(cfg.Script) == "" {
+				report.errorf(name, "ws_client script is missing")
+			} else {
+				checkScriptCompiles(report, name, resolvePath(baseDir, cfg.Script), true)
+			}
+			if strings.TrimSpace(cfg.ConnectURL) == "" {
+				report.errorf(name, "ws_client connectURL is missing")
+			} else if _, err := resolveConnectURL(cfg.ConnectURL); err != nil {
+				report.errorf(name, "ws_client connectURL: %v", err)
+			}
+			if cfg.Push != "" {
+				report.warnf(name, "push is ignored for ws_client")
+			}
+			continue
+		}
+		if t := strings.TrimSpace(cfg.Type); t != "" {
+			report.errorf(name, "unknown type: %s", t)
+		}
+
+		if strings.TrimSpace(cfg.Script) == "" && strings.TrimSpace(cfg.HTML) == "" {
+			report.errorf(name, "either script or html is required")
+		}
+		if strings.TrimSpace(cfg.Script) != "" {
+			checkScriptCompiles(report, name, resolvePath(baseDir, cfg.Script), true)
+		}
+		if strings.TrimSpace(cfg.HTML) != "" {
+			checkFileExists(report, name, resolvePath(baseDir, cfg.HTML))
+		}
+		for _, scriptPath := range []string{cfg.WSAuth, cfg.OnOpen, cfg.OnClose} {
+			if strings.TrimSpace(scriptPath) != "" {
+				checkScriptCompiles(report, name, resolvePath(baseDir, scriptPath), true)
+			}
+		}
+		for _, method := range cfg.Methods {
+			switch method {
+			case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+				http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+			default:
+				report.errorf(name, "unknown HTTP method: %s", method)
+			}
+		}
+
+		if cfg.Push != "" {
+			target, ok := api[cfg.Push]
+			if !ok {
+				report.errorf(name, "push target %s is not defined", cfg.Push)
+			} else if strings.TrimSpace(target.Type) == apiTypeWSClient {
+				report.errorf(name, "push target %s is a ws_client", cfg.Push)
 			}
 		}
 	}
 
-	bodyBytes, err := jsBodyToBytes(respMap["body"])
+	return report
+}
+
+// checkFileExists はファイルが存在することを確認します。
+func checkFileExists(report *validationReport, target, path string) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return true, err
+		report.errorf(target, "file not found: %s", path)
+		return
+	}
+	if info.IsDir() {
+		report.errorf(target, "%s is a directory", path)
+	}
+}
+
+// checkScriptCompiles はスクリプトが存在し、コンパイルできることを確認します。
+func checkScriptCompiles(report *validationReport, target, path string, block bool) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		report.errorf(target, "script not found: %s", path)
+		return
+	}
+	if _, err := goja.Compile(path, wrapScriptSource(string(code), block), false); err != nil {
+		report.errorf(target, "script does not compile: %v", err)
+	}
+}
+
+// resolvePath は絶対パスを返すユーティリティ関数です。
+func resolvePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// loadConfig は設定ファイルを読み込みます。
+func loadConfig(filename string) (Config, error) {
+	var config Config
+
+	// 設定ファイルを読み込む
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+
+	// 設定ファイルの内容をConfig構造体にパースする
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// apiの設定を読み込みます。
+func loadAPIConfig(filePath string) (APIConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var apiConfig APIConfig
+	if err := json.Unmarshal(data, &apiConfig); err != nil {
+		return nil, err
+	}
+	for name, cfg := range apiConfig {
+		cfg.Name = name
+		for i, method := range cfg.Methods {
+			cfg.Methods[i] = strings.ToUpper(strings.TrimSpace(method))
+		}
+		apiConfig[name] = cfg
+	}
+	return apiConfig, nil
+}
+
+// registerEndpoint は api.json のエンドポイントを gin のルーターに登録します。
+// エンドポイント名には gin のパスパラメータ（:id や *path）を使用できます。
+func registerEndpoint(r *gin.Engine, config EndpointConfig) (err error) {
+	defer func() {
+		// パスの競合などで gin が panic した場合はエラーとして返す
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("failed to register endpoint %s: %v", config.Name, recovered)
+		}
+	}()
+	r.Any("/"+config.Name, func(c *gin.Context) {
+		handleAPIRequestOrWebSocket(c, config)
+	})
+	return nil
+}
+
+// allowedMethods は Allow ヘッダーに設定するメソッドの一覧を返します。
+func allowedMethods(config EndpointConfig) []string {
+	methods := append([]string{}, config.Methods...)
+	hasHead := false
+	hasGet := false
+	for _, method := range methods {
+		switch method {
+		case http.MethodHead:
+			hasHead = true
+		case http.MethodGet:
+			hasGet = true
+		}
+	}
+	if hasGet && !hasHead {
+		methods = append(methods, http.MethodHead)
+	}
+	return append(methods, http.MethodOptions)
+}
+
+// isMethodAllowed はエンドポイントがリクエストのメソッドを受け付けるかを判定します。
+func isMethodAllowed(config EndpointConfig, method string) bool {
+	if len(config.Methods) == 0 {
+		return true
+	}
+	for _, allowed := range allowedMethods(config) {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// スクリプト実行のデフォルトのタイムアウト
+const defaultScriptTimeout = 30 * time.Second
+
+// scriptTimeout はエンドポイントのスクリプト実行タイムアウトを返します。
+func scriptTimeout(config EndpointConfig) time.Duration {
+	if config.Timeout > 0 {
+		return time.Duration(config.Timeout) * time.Second
+	}
+	if timeout := currentConfig().ScriptTimeout; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return defaultScriptTimeout
+}
+
+// isScriptTimeout はスクリプトがタイムアウトで中断されたかを判定します。
+func isScriptTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// respondScriptError はスクリプト実行エラーを返します。タイムアウトの場合は 504 を返します。
+func respondScriptError(c *gin.Context, config EndpointConfig, err error) {
+	if isScriptTimeout(err) {
+		requestLogger(c).Warn("Script timed out", "timeout", scriptTimeout(config))
+		c.JSON(http.StatusGatewayTimeout, ResponseData{
+			Success: false,
+			Error: &ErrorData{
+				Code:    http.StatusGatewayTimeout,
+				Message: fmt.Sprintf("script execution timed out on endpoint %s", config.Name),
+			},
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// handleAPIRequestOrWebSocket はAPIリクエストまたはWebSocketリクエストを処理します。
+func handleAPIRequestOrWebSocket(c *gin.Context, config EndpointConfig) {
+	c.Set(currentAPINameKey, config.Name)
+	setRequestLogger(c, endpointLogger(requestLogger(c), config.Name, config.LogLevel))
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		handleWebSocket(c, config)
+		return
+	}
+	if !isMethodAllowed(config, c.Request.Method) {
+		c.Header("Allow", strings.Join(allowedMethods(config), ", "))
+		c.JSON(http.StatusMethodNotAllowed, ResponseData{
+			Success: false,
+			Error: &ErrorData{
+				Code:    http.StatusMethodNotAllowed,
+				Message: fmt.Sprintf("method %s is not allowed on endpoint %s", c.Request.Method, config.Name),
+			},
+		})
+		return
+	}
+	handleAPIRequest(c, config)
+}
+
+// handleAPIRequest はAPIリクエストを処理します。
+func handleAPIRequest(c *gin.Context, config EndpointConfig) {
+	// HTTP/2サーバープッシュの処理は削除
+
+	// リクエストのコンテンツタイプを取得
+	contentType := c.ContentType()
+
+	// リクエストボディを nyanRequest 用に保持（アップロードはファイルとして扱う）
+	var uploads map[string][]map[string]interface{}
+	if contentType == "multipart/form-data" {
+		files, cleanup, err := parseMultipartUploads(c, config)
+		defer cleanup()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Upload exceeds %d bytes", tooLarge.Limit)})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart form data"})
+			return
+		}
+		uploads = files
+	} else if _, err := captureRequestBody(c, maxBodySize(config)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	// リクエストパラメータの収集
+	allParams := make(map[string]interface{})
+	if contentType == "application/json" {
+		var requestData map[string]interface{}
+		if err := c.BindJSON(&requestData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+			return
+		}
+		for k, v := range requestData {
+			allParams[k] = v
+		}
+	}
+
+	// URLクエリパラメータとPOSTフォームパラメータを追加
+	c.Request.ParseForm()
+	for k, v := range c.Request.PostForm {
+		allParams[k] = v[0]
+	}
+	for k, v := range uploads {
+		allParams[k] = v[0]
+	}
+	for k, v := range c.Request.URL.Query() {
+		allParams[k] = v[0]
+	}
+
+	if allParams["api"] == nil {
+		if c.Request.URL.Path != "/" {
+			allParams["api"] = c.Request.URL.Path
+		} else {
+			allParams["api"] = "html"
+		}
+	}
+
+	// スクリプトとHTMLファイルのパスを取得
+	scriptPath := resolvePath(baseDir, config.Script)
+	htmlPath := ""
+	if strings.TrimSpace(config.HTML) != "" {
+		htmlPath = resolvePath(baseDir, config.HTML)
+	}
+
+	// scriptが空の場合、HTMLファイルの内容をそのまま返す
+	if config.Script == "" {
+		htmlContent, err := os.ReadFile(htmlPath)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load HTML file"})
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", htmlContent)
+		return
+	}
+
+	// JavaScriptを実行し、結果を取得（タイムアウトはリクエストのコンテキストに設定）
+	ctx, cancel := context.WithTimeout(c.Request.Context(), scriptTimeout(config))
+	defer cancel()
+	resultValue, err := runJavaScriptValue(ctx, c, scriptPath, htmlPath, allParams)
+	if err != nil {
+		respondScriptError(c, config, err)
+		return
+	}
+
+	if handled, err := writeJSResponse(c, resultValue); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	} else if handled {
+		return
+	}
+
+	// HTML出力として結果を返す
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(resultValue.text))
+
+	// push 設定がある場合、対象のWebSocket接続に対してプッシュ
+	// API リクエスト完了後の push 処理
+	performPush(context.WithoutCancel(c.Request.Context()), config, allParams)
+
+}
+
+// handleWebSocket はWebSocketリクエストを処理します。
+func handleWebSocket(c *gin.Context, config EndpointConfig) {
+	// push の宛先と一致させるため、接続はエンドポイント名で登録する
+	endpoint := config.Name
+
+	// ws_auth が設定されていればアップグレード前に接続を許可するか判定する
+	identity, ok := authorizeWebSocket(c, config)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		requestLogger(c).Error("Failed to set websocket upgrade", "error", err)
+		sendHTMLErrorResponse(c.Writer, "WebSocket upgrade failed")
+		return
+	}
+	wc := newWSConnection(config, conn, identity)
+	// スクリプトの console にも接続 ID を付ける
+	setRequestLogger(c, requestLogger(c).With("connection_id", wc.id))
+	logger := requestLogger(c)
+
+	// 登録処理
+	wsConnections.Lock()
+	wsConnections.conns[endpoint] = append(wsConnections.conns[endpoint], wc)
+	wsConnections.Unlock()
+
+	// 接続終了時に削除する
+	defer func() {
+		wc.close()
+
+		if strings.TrimSpace(config.OnClose) != "" {
+			runWebSocketScript(c, config, wc, config.OnClose, map[string]interface{}{"ws_event": "close"})
+		}
+	}()
+
+	if strings.TrimSpace(config.OnOpen) != "" {
+		reply := runWebSocketScript(c, config, wc, config.OnOpen, map[string]interface{}{"ws_event": "open"})
+		if reply != nil {
+			if err := wc.write(websocket.TextMessage, reply); err != nil {
+				logger.Error("Error writing message", "error", err)
+				return
+			}
+		}
+	}
+
+	// idle_timeout の間メッセージを受信しなければ切断する（受信のたびに延ばす）
+	var idle *time.Timer
+	if idleTimeout := wc.keepalive.idleTimeout; idleTimeout > 0 {
+		idle = time.AfterFunc(idleTimeout, func() {
+			logger.Info("Closing idle WebSocket connection", "idle_timeout", idleTimeout)
+			addMetric("nyanpui_websocket_timeouts_total", 1, endpoint, "idle")
+			wc.closeIdle()
+		})
+		defer idle.Stop()
+	}
+
+	for {
+		wc.keepalive.extendRead(conn)
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if wc.closed() || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Info("WebSocket connection closed", "reason", err)
+				break
+			}
+			if isTimeoutError(err) {
+				// pong_wait の間 pong もメッセージも届かなかった（相手が応答しない）
+				logger.Info("WebSocket peer did not respond to ping, closing connection", "pong_wait", wc.keepalive.pongWait)
+				addMetric("nyanpui_websocket_timeouts_total", 1, endpoint, "pong")
+				break
+			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				logger.Warn("WebSocket message exceeds max_message_size, closing connection",
+					"max_message_size", wc.keepalive.maxMessageSize)
+				break
+			}
+			// 読み込みに失敗した接続には書き込まない（プロトコル違反の close フレームは gorilla/websocket が送る）
+			logger.Error("Error reading message", "error", err)
+			break
+		}
+		logger.Debug("Received message", "message", string(message))
+		if idle != nil {
+			idle.Reset(wc.keepalive.idleTimeout)
+		}
+
+		// スクリプトがないエンドポイントは従来どおり api の HTML を返すかエコーする
+		if strings.TrimSpace(config.Script) == "" {
+			handleWebSocketMessageWithoutScript(wc, logger, messageType, message)
+			continue
+		}
+
+		// nyanRequest.body などは受信したメッセージにする
+		c.Set(rawBodyKey, message)
+		reply := runWebSocketScript(c, config, wc, config.Script, webSocketMessageParams(messageType, message))
+		if reply == nil {
+			continue
+		}
+		if err := wc.write(websocket.TextMessage, reply); err != nil {
+			logger.Error("Error writing message", "error", err)
+			break
+		}
+	}
+}
+
+// webSocketMessageParams は受信したメッセージをスクリプトの nyanAllParams に渡す形にします。
+// JSON のオブジェクトの場合は HTTP のリクエストと同じく各キーも nyanAllParams に展開します。
+func webSocketMessageParams(messageType int, message []byte) map[string]interface{} {
+	params := map[string]interface{}{}
+	var decoded interface{}
+	if messageType == websocket.TextMessage && json.Unmarshal(message, &decoded) == nil {
+		if object, ok := decoded.(map[string]interface{}); ok {
+			for key, value := range object {
+				params[key] = value
+			}
+		}
+		params["ws_message_json"] = decoded
+	}
+	params["ws_event"] = "message"
+	params["ws_message_type"] = websocketMessageTypeLabel(messageType)
+	params["ws_message_text"] = string(message)
+	if messageType == websocket.BinaryMessage {
+		params["ws_message_base64"] = base64.StdEncoding.EncodeToString(message)
+	}
+	return params
+}
+
+// runWebSocketScript は WebSocket の接続に対してスクリプトを実行し、返信する内容を返します。
+// nyanAllParams には params に加えて接続 ID、エンドポイント名、ws_auth の identity が入ります。
+// 返り値が空の場合は nil、文字列以外の値は JSON にします。エラーの場合はエラーの JSON を返します。
+func runWebSocketScript(c *gin.Context, config EndpointConfig, wc *wsConnection, scriptPath string, params map[string]interface{}) []byte {
+	params["api"] = config.Name
+	params["ws_endpoint"] = config.Name
+	params["ws_connection_id"] = wc.id
+	params["ws_identity"] = wc.identity
+
+	// 切断後の on_close も実行できるよう、接続の終了ではキャンセルしない
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), scriptTimeout(config))
+	defer cancel()
+	result, err := runJavaScriptValue(ctx, c, scriptPath, config.HTML, params)
+	if err != nil {
+		requestLogger(c).Error("WebSocket script error", "script", scriptPath, "error", err)
+		code := http.StatusInternalServerError
+		message := err.Error()
+		if isScriptTimeout(err) {
+			code = http.StatusGatewayTimeout
+			message = fmt.Sprintf("script execution timed out on endpoint %s", config.Name)
+		}
+		reply, _ := json.Marshal(ResponseData{Success: false, Error: &ErrorData{Code: code, Message: message}})
+		return reply
+	}
+	if result.empty {
+		return nil
+	}
+	if text, ok := result.value.(string); ok {
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		return []byte(text)
+	}
+	reply, err := json.Marshal(result.value)
+	if err != nil {
+		return []byte(result.text)
+	}
+	return reply
+}
+
+// handleWebSocketMessageWithoutScript はスクリプトのないエンドポイントで受信したメッセージを処理します。
+// {"api": "name"} の場合はそのエンドポイントの HTML を返し、それ以外はエコーします。
+func handleWebSocketMessageWithoutScript(wc *wsConnection, logger *slog.Logger, messageType int, message []byte) {
+	// 受信したメッセージを JSON としてパース
+	var req map[string]interface{}
+	if err := json.Unmarshal(message, &req); err != nil {
+		logger.Warn("Invalid JSON received", "error", err)
+		// JSON パースに失敗した場合はエコーするか、エラーメッセージを返す
+		wc.write(messageType, []byte("Invalid JSON"))
+		return
+	}
+
+	// "api" キーがあるかチェック
+	apiName, ok := req["api"].(string)
+	if !ok {
+		// "api" キーが無い場合はエコーするか、適宜処理を追加
+		if err := wc.write(messageType, message); err != nil {
+			logger.Error("Error writing echo message", "error", err)
+		}
+		return
+	}
+
+	// apiConfig から対象の設定を取得
+	apiCfg, found := currentAPIConfig()[apiName]
+	if !found {
+		errMsg := fmt.Sprintf("API %s not found", apiName)
+		wc.write(messageType, []byte(errMsg))
+		return
+	}
+	// 例として、スクリプトが空の場合は HTML ファイルの内容を返す実装
+	htmlPath := resolvePath(baseDir, apiCfg.HTML)
+	content, err := os.ReadFile(htmlPath)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to read HTML file for API %s: %v", apiName, err)
+		wc.write(messageType, []byte(errMsg))
+		return
+	}
+	// 取得した内容を返信
+	if err := wc.write(websocket.TextMessage, content); err != nil {
+		logger.Error("Error writing message", "api", apiName, "error", err)
+	}
+}
+
+// closeWebSocketConnections はすべての WebSocket 接続に close フレーム（1001 Going Away）を送り、
+// 切断されるのを ctx の期限まで待ちます。期限までに切断されなかった接続は強制的に閉じます。
+func closeWebSocketConnections(ctx context.Context) {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	// 書き込みは接続ごとに期限まで待つことがあるため、ロックの外で並行して送る
+	var wg sync.WaitGroup
+	for _, wc := range webSocketConnectionList() {
+		wg.Add(1)
+		go func(wc *wsConnection) {
+			defer wg.Done()
+			if err := wc.conn.WriteControl(websocket.CloseMessage, closeMessage, deadline); err != nil {
+				slog.Warn("Failed to send close frame", "endpoint", wc.endpoint, "error", err)
+			}
+		}(wc)
+	}
+	wg.Wait()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		remaining := webSocketConnectionList()
+		if len(remaining) == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Warn("Closing WebSocket connections that did not close in time", "count", len(remaining))
+			for _, wc := range remaining {
+				wc.conn.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// webSocketConnectionList は登録中の WebSocket 接続の一覧をコピーして返します。
+func webSocketConnectionList() []*wsConnection {
+	wsConnections.RLock()
+	defer wsConnections.RUnlock()
+	var list []*wsConnection
+	for _, conns := range wsConnections.conns {
+		list = append(list, conns...)
+	}
+	return list
+}
+
+// checkWebSocketOrigin は WebSocket の接続元の Origin が config.json の websocket.allowed_origins に含まれるかを判定します。
+// allowed_origins が空の場合は gorilla/websocket のデフォルトと同じく、同じホストからの接続だけを許可します。
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// ブラウザ以外（ws_client など）からの接続
+		return true
+	}
+	allowed := currentConfig().WebSocket.AllowedOrigins
+	if len(allowed) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	return matchOrigin(allowed, origin)
+}
+
+// authorizeWebSocket は ws_auth スクリプトを実行し、接続を許可するかを判定します。
+// スクリプトは false / null / undefined を返すと拒否、true を返すと許可します。
+// オブジェクトを返した場合は allow（省略時 true）で判定し、identity を接続に付与します。
+// 拒否する場合は status（省略時 403）と message でレスポンスを返します。
+// 拒否した場合やエラーの場合はレスポンスを書き込み、false を返します。
+func authorizeWebSocket(c *gin.Context, config EndpointConfig) (interface{}, bool) {
+	if strings.TrimSpace(config.WSAuth) == "" {
+		return nil, true
+	}
+	logger := requestLogger(c)
+
+	allParams := map[string]interface{}{"api": config.Name}
+	for key, values := range c.Request.URL.Query() {
+		if len(values) > 0 {
+			allParams[key] = values[0]
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), scriptTimeout(config))
+	defer cancel()
+	result, err := runJavaScriptValue(ctx, c, config.WSAuth, "", allParams)
+	if err != nil {
+		logger.Error("ws_auth script failed", "error", err)
+		respondScriptError(c, config, err)
+		return nil, false
+	}
+
+	decision := result.value
+	if text, ok := decision.(string); ok {
+		// JSON.stringify した結果を返すスクリプトにも対応する
+		var decoded interface{}
+		if json.Unmarshal([]byte(text), &decoded) == nil {
+			decision = decoded
+		}
+	}
+
+	allow := false
+	var identity interface{}
+	status := http.StatusForbidden
+	message := "WebSocket connection rejected"
+	switch v := decision.(type) {
+	case bool:
+		allow = v
+	case map[string]interface{}:
+		allow = true
+		if value, ok := v["allow"].(bool); ok {
+			allow = value
+		}
+		// push の絞り込みで比較できるよう JSON の値にそろえておく
+		identity = normalizeJSONValue(v["identity"])
+		if code, ok := parseStatusCode(v["status"]); ok {
+			status = code
+		}
+		if text, ok := v["message"].(string); ok && text != "" {
+			message = text
+		}
+	}
+	if !allow {
+		logger.Info("WebSocket connection rejected by ws_auth", "status", status)
+		c.JSON(status, ResponseData{
+			Success: false,
+			Error:   &ErrorData{Code: status, Message: message},
+		})
+		return nil, false
+	}
+	return identity, true
+}
+
+// sendHTMLErrorResponse はWebSocketアップグレードの際に発生したエラーをHTMLでクライアントに送信します。
+func sendHTMLErrorResponse(w http.ResponseWriter, errorMessage string) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusInternalServerError)
+	errorHTML := fmt.Sprintf("<html><body><h1>Error</h1><p>%s</p></body></html>", errorMessage)
+	w.Write([]byte(errorHTML))
+}
+
+// runJavaScript はJavaScriptを実行します。
+func runJavaScript(ctx context.Context, c *gin.Context, scriptPath string, htmlPath string, allParams map[string]interface{}) (string, error) {
+	result, err := runJavaScriptValue(ctx, c, scriptPath, htmlPath, allParams)
+	if err != nil {
+		return "", err
+	}
+	return result.text, nil
+}
+
+// resolveCurrentAPINameFromContext は現在の HTTP リクエストから API 名を解決します。
+func resolveCurrentAPINameFromContext(c *gin.Context) string {
+	if c == nil || c.Request == nil || c.Request.URL == nil {
+		return ""
+	}
+
+	// JSON-RPC など、URL 以外で API 名が決まる場合
+	if apiName := strings.TrimSpace(c.GetString(currentAPINameKey)); apiName != "" {
+		return apiName
+	}
+
+	if apiName := strings.TrimSpace(c.Query("api")); apiName != "" {
+		return apiName
+	}
+
+	// パスパラメータを含むエンドポイントは登録したパターンで解決する
+	if fullPath := c.FullPath(); fullPath != "" && fullPath != "/" {
+		return strings.TrimPrefix(fullPath, "/")
+	}
+
+	path := strings.TrimSpace(c.Request.URL.Path)
+	if path == "" || path == "/" {
+		return "html"
+	}
+	return strings.TrimPrefix(path, "/")
+}
+
+// gin.Context に保存する値のキー
+const (
+	rawBodyKey        = "nyanRawBody"
+	currentAPINameKey = "nyanAPIName"
+	requestIDKey      = "nyanRequestID"
+	uploadsKey        = "nyanUploads"
+	uploadTempKey     = "nyanUploadTempFiles"
+)
+
+// アップロードの上限のデフォルト
+const (
+	defaultMaxUploadSize       = 32 << 20
+	defaultUploadInlineMaxSize = 1 << 20
+	defaultMaxBodySize         = 10 << 20
+)
+
+// maxUploadSize はエンドポイントのアップロード上限を返します。
+func maxUploadSize(config EndpointConfig) int64 {
+	if config.MaxUploadSize > 0 {
+		return config.MaxUploadSize
+	}
+	return defaultMaxUploadSize
+}
+
+// maxBodySize はエンドポイントのリクエストボディの上限を返します。
+func maxBodySize(config EndpointConfig) int64 {
+	if config.MaxBodySize > 0 {
+		return config.MaxBodySize
+	}
+	if limit := currentConfig().MaxBodySize; limit > 0 {
+		return limit
+	}
+	return defaultMaxBodySize
+}
+
+// parseMultipartUploads は multipart/form-data を解析し、アップロードされたファイルを
+// スクリプトに渡すオブジェクトとしてフィールド名ごとに返します。
+// 返却される cleanup はエラー時も含めて必ず呼び出し、一時ファイルを削除してください。
+func parseMultipartUploads(c *gin.Context, config EndpointConfig) (map[string][]map[string]interface{}, func(), error) {
+	var tempFiles []string
+	cleanup := func() {
+		for _, path := range tempFiles {
+			os.Remove(path)
+		}
+		if c.Request.MultipartForm != nil {
+			c.Request.MultipartForm.RemoveAll()
+		}
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize(config))
+	if err := c.Request.ParseMultipartForm(defaultUploadInlineMaxSize); err != nil {
+		return nil, cleanup, err
+	}
+
+	inlineMax := currentConfig().Upload.InlineMaxSize
+	if inlineMax <= 0 {
+		inlineMax = defaultUploadInlineMaxSize
+	}
+
+	uploads := make(map[string][]map[string]interface{})
+	for field, headers := range c.Request.MultipartForm.File {
+		for _, header := range headers {
+			file := map[string]interface{}{
+				"field":       field,
+				"filename":    header.Filename,
+				"contentType": header.Header.Get("Content-Type"),
+				"size":        header.Size,
+			}
+
+			src, err := header.Open()
+			if err != nil {
+				return nil, cleanup, err
+			}
+			if f, ok := src.(*os.File); ok && header.Size > inlineMax {
+				// ディスクに保存済みのファイルはコピーせずにそのまま渡す（削除は MultipartForm.RemoveAll）
+				f.Close()
+				tempFiles = append(tempFiles, f.Name())
+				file["path"] = f.Name()
+			} else if header.Size <= inlineMax {
+				data, err := io.ReadAll(src)
+				src.Close()
+				if err != nil {
+					return nil, cleanup, err
+				}
+				file["data"] = base64.StdEncoding.EncodeToString(data)
+			} else {
+				tmp, err := os.CreateTemp("", "nyanpui-upload-*")
+				if err != nil {
+					src.Close()
+					return nil, cleanup, err
+				}
+				tempFiles = append(tempFiles, tmp.Name())
+				_, err = io.Copy(tmp, src)
+				src.Close()
+				tmp.Close()
+				if err != nil {
+					return nil, cleanup, err
+				}
+				file["path"] = tmp.Name()
+			}
+			uploads[field] = append(uploads[field], file)
+		}
+	}
+
+	c.Set(uploadsKey, uploads)
+	c.Set(uploadTempKey, tempFiles)
+	return uploads, cleanup, nil
+}
+
+// resolveUploadDestination は保存先が upload.dirs のいずれかの配下であることを確認して絶対パスを返します。
+func resolveUploadDestination(baseDir, destPath string) (string, error) {
+	dirs := currentConfig().Upload.Dirs
+	if len(dirs) == 0 {
+		return "", fmt.Errorf("no upload directories are configured")
+	}
+	// シンボリックリンクで upload.dirs の外へ書き込めないよう、リンクを解決してから比較する
+	dest, err := evalSymlinksExisting(resolvePath(baseDir, destPath))
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		dir, err := evalSymlinksExisting(resolvePath(baseDir, dir))
+		if err != nil {
+			continue
+		}
+		if !isWithinDir(dir, dest) {
+			continue
+		}
+		return dest, nil
+	}
+	return "", fmt.Errorf("destination %s is outside the upload directories", destPath)
+}
+
+// resolveScriptReadPath はスクリプトから読み込むファイルのパスを解決します。
+// restrict_script_reads の場合は、ベースディレクトリか script_read_dirs のいずれかの配下であることを確認します。
+func resolveScriptReadPath(baseDir, path string) (string, error) {
+	config := currentConfig()
+	if !config.RestrictScriptReads {
+		return resolvePath(baseDir, path), nil
+	}
+	fullPath, err := evalSymlinksExisting(resolvePath(baseDir, path))
+	if err != nil {
+		return "", err
+	}
+	dirs := append([]string{"."}, config.ScriptReadDirs...)
+	for _, dir := range dirs {
+		dir, err := evalSymlinksExisting(resolvePath(baseDir, dir))
+		if err != nil {
+			continue
+		}
+		if isWithinDir(dir, fullPath) {
+			return fullPath, nil
+		}
+	}
+	return "", fmt.Errorf("%s is outside the readable directories", path)
+}
+
+// isWithinDir は path が dir の配下（dir 自身は含まない）であるかを返します。
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evalSymlinksExisting は path のうち存在する部分のシンボリックリンクを解決し、
+// 存在しない残りの要素をつなげたパスを返します。
+func evalSymlinksExisting(path string) (string, error) {
+	path = filepath.Clean(path)
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// saveUpload はアップロードされたファイル（スクリプトに渡したオブジェクト）を destPath に保存します。
+func saveUpload(c *gin.Context, baseDir string, file map[string]interface{}, destPath string) (string, error) {
+	dest, err := resolveUploadDestination(baseDir, destPath)
+	if err != nil {
+		return "", err
+	}
+
+	var src io.Reader
+	if data, ok := file["data"].(string); ok {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", fmt.Errorf("invalid upload data: %w", err)
+		}
+		src = bytes.NewReader(decoded)
+	} else if path, ok := file["path"].(string); ok {
+		// このリクエストで作成した一時ファイル以外は受け付けない
+		var tempFiles []string
+		if c != nil {
+			if raw, ok := c.Get(uploadTempKey); ok {
+				tempFiles, _ = raw.([]string)
+			}
+		}
+		known := false
+		for _, tempFile := range tempFiles {
+			if tempFile == path {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return "", fmt.Errorf("file is not an upload of the current request")
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return "", err
+		}
+		// 一時ファイルはハードリンクで保存し、別のファイルシステムなどでリンクできない場合だけコピーする
+		if linkUpload(path, dest) == nil {
+			return dest, nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		src = f
+	} else {
+		return "", fmt.Errorf("file has neither data nor path")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// linkUpload は一時ファイル path を dest にハードリンクします。dest が既にある場合は置き換えます。
+func linkUpload(path, dest string) error {
+	tmp := dest + ".nyanpui-tmp"
+	os.Remove(tmp)
+	if err := os.Link(path, tmp); err != nil {
+		return err
+	}
+	// 一時ファイルは 0600 で作成されるため、os.Create で保存した場合と同じ権限にする
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err := os.Rename(tmp, dest)
+	// 同じファイルへのリンクどうしの rename は何もしないため、残った tmp も削除する
+	os.Remove(tmp)
+	return err
+}
+
+// captureRequestBody はリクエストボディを読み込んで gin.Context に保存し、
+// 後続の処理で再度読めるようにボディを差し戻します。
+// limit バイトを超える場合は *http.MaxBytesError を返します。
+func captureRequestBody(c *gin.Context, limit int64) ([]byte, error) {
+	if c.Request.Body == nil {
+		c.Set(rawBodyKey, []byte{})
+		return []byte{}, nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+	c.Request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Set(rawBodyKey, body)
+	return body, nil
+}
+
+// buildNyanRequest はスクリプトに渡す nyanRequest オブジェクトを作成します。
+func buildNyanRequest(c *gin.Context) map[string]interface{} {
+	r := c.Request
+
+	headers := make(map[string]interface{}, len(r.Header)+1)
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	if r.Host != "" {
+		headers["host"] = r.Host
+	}
+
+	query := make(map[string]interface{})
+	for key, values := range r.URL.Query() {
+		query[key] = values
+	}
+
+	form := make(map[string]interface{})
+	if r.PostForm != nil {
+		for key, values := range r.PostForm {
+			form[key] = values
+		}
+	}
+
+	var body []byte
+	if raw, ok := c.Get(rawBodyKey); ok {
+		body, _ = raw.([]byte)
+	}
+
+	cookies := map[string]string{}
+	for _, cookie := range r.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+
+	files := map[string][]map[string]interface{}{}
+	if raw, ok := c.Get(uploadsKey); ok {
+		files, _ = raw.(map[string][]map[string]interface{})
+	}
+
+	return map[string]interface{}{
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"url":        r.URL.RequestURI(),
+		"host":       r.Host,
+		"protocol":   r.Proto,
+		"headers":    headers,
+		"cookies":    cookies,
+		"query":      query,
+		"form":       form,
+		"files":      files,
+		"body":       string(body),
+		"bodyBase64": base64.StdEncoding.EncodeToString(body),
+		"remoteAddr": r.RemoteAddr,
+		"clientIP":   c.ClientIP(),
+		"tls":        tlsInfo(r.TLS),
+		"requestId":  c.GetString(requestIDKey),
+	}
+}
+
+// tlsInfo は TLS 接続の情報を返します。TLS でない場合は nil です。
+func tlsInfo(state *tls.ConnectionState) map[string]interface{} {
+	if state == nil {
+		return nil
+	}
+	peers := make([]interface{}, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		peers = append(peers, map[string]interface{}{
+			"subject": cert.Subject.String(),
+			"issuer":  cert.Issuer.String(),
+			"serial":  cert.SerialNumber.String(),
+		})
+	}
+	return map[string]interface{}{
+		"version":          tls.VersionName(state.Version),
+		"cipherSuite":      tls.CipherSuiteName(state.CipherSuite),
+		"serverName":       state.ServerName,
+		"negotiatedProto":  state.NegotiatedProtocol,
+		"peerCertificates": peers,
+	}
+}
+
+// callNyanAPIFromVM は、JavaScript(VM) から api.json 定義の API を内部実行します。
+// ctx と c は呼び出し元スクリプトのもので、呼び出し元の期限とリクエストを引き継ぎます。
+func callNyanAPIFromVM(ctx context.Context, c *gin.Context, apiName string, allParams map[string]interface{}) (interface{}, error) {
+	if strings.TrimSpace(apiName) == "" {
+		return nil, fmt.Errorf("api name is required")
+	}
+
+	apiCfg, found := currentAPIConfig()[apiName]
+	if !found {
+		return nil, fmt.Errorf("API config not found: %s", apiName)
+	}
+	if strings.TrimSpace(apiCfg.Type) == apiTypeWSClient {
+		return nil, fmt.Errorf("API %s is ws_client and cannot be called by nyanCallMe", apiName)
+	}
+	if strings.TrimSpace(apiCfg.Script) == "" {
+		return nil, fmt.Errorf("script not found for API %s", apiName)
+	}
+
+	params := make(map[string]interface{}, len(allParams)+1)
+	for key, value := range allParams {
+		params[key] = value
+	}
+	params["api"] = apiName
+
+	ctx, cancel := context.WithTimeout(ctx, scriptTimeout(apiCfg))
+	defer cancel()
+	resultValue, err := runJavaScriptValue(ctx, c, apiCfg.Script, apiCfg.HTML, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run API %s: %w", apiName, err)
+	}
+	if resultValue.empty {
+		return nil, nil
+	}
+
+	exported := resultValue.value
+	if asText, ok := exported.(string); ok {
+		var parsed interface{}
+		if json.Unmarshal([]byte(asText), &parsed) == nil {
+			return parsed, nil
+		}
+	}
+	return exported, nil
+}
+
+// scriptResult はスクリプトの実行結果です。
+// ランタイムはプールへ返却されるため、goja.Value ではなく Go の値に変換して保持します。
+type scriptResult struct {
+	value interface{} // Export() した値
+	text  string      // String() した値
+	empty bool        // undefined または null
+}
+
+// jsRuntime はプールで再利用する goja ランタイムです。
+type jsRuntime struct {
+	vm        *goja.Runtime
+	includes  []*goja.Program // 評価済みのインクルードプログラム
+	jsonParse goja.Callable
+	ctx       context.Context       // 実行中のスクリプトのコンテキスト（外部呼び出しに引き継ぐ）
+	gin       *gin.Context          // 実行中のスクリプトの HTTP リクエスト（無い場合は nil）
+	globals   map[string]goja.Value // インクルード評価直後のグローバル変数（返却時にこの状態へ戻す）
+}
+
+// compiledScript はコンパイル済みのプログラムと、コンパイル時のファイル情報を保持します。
+type compiledScript struct {
+	modTime time.Time
+	size    int64
+	program *goja.Program
+}
+
+type scriptCacheKey struct {
+	path  string
+	block bool
+}
+
+// コンパイル済みスクリプトのキャッシュ（ファイルの更新日時が変わると再コンパイル）
+var scriptCache = struct {
+	sync.RWMutex
+	programs map[scriptCacheKey]compiledScript
+}{
+	programs: make(map[scriptCacheKey]compiledScript),
+}
+
+// インクルード評価済みの goja ランタイムのプール
+var runtimePool sync.Pool
+
+// wrapScriptSource は block が true の場合にスクリプトをブロック文で囲みます。
+// 行番号がずれないよう、開きカッコは先頭行に置きます。
+func wrapScriptSource(src string, block bool) string {
+	if !block {
+		return src
+	}
+	return "{" + src + "\n}"
+}
+
+// compileScriptFile はファイルをコンパイルし、キャッシュします。
+// block が true の場合はブロック文で囲み、トップレベルの let/const が
+// 再利用されるランタイム上で衝突しないようにします。
+func compileScriptFile(path string, block bool) (*goja.Program, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JavaScript file %s: %v", path, err)
+	}
+	key := scriptCacheKey{path: path, block: block}
+
+	scriptCache.RLock()
+	cached, ok := scriptCache.programs[key]
+	scriptCache.RUnlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.program, nil
+	}
+
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JavaScript file %s: %v", path, err)
+	}
+	program, err := goja.Compile(path, wrapScriptSource(string(code), block), false)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Compiled JavaScript file", "path", path)
+
+	scriptCache.Lock()
+	scriptCache.programs[key] = compiledScript{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		program: program,
+	}
+	scriptCache.Unlock()
+	return program, nil
+}
+
+// loadIncludePrograms は config.json の javascript_include をコンパイル済みプログラムとして返します。
+func loadIncludePrograms(baseDir string) ([]*goja.Program, error) {
+	includes := currentConfig().JavaScriptInclude
+	programs := make([]*goja.Program, 0, len(includes))
+	for _, includePath := range includes {
+		includePath = resolvePath(baseDir, includePath)
+		program, err := compileScriptFile(includePath, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load included JS file %s: %v", includePath, err)
+		}
+		programs = append(programs, program)
+	}
+	return programs, nil
+}
+
+// sameIncludes は評価済みのインクルードが現在のものと一致するかを判定します。
+func sameIncludes(a, b []*goja.Program) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// acquireRuntime はインクルード評価済みのランタイムをプールから取得します。
+// インクルードが更新されている場合は新しいランタイムを作成します。
+func acquireRuntime(baseDir string) (*jsRuntime, error) {
+	includes, err := loadIncludePrograms(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if pooled, ok := runtimePool.Get().(*jsRuntime); ok && sameIncludes(pooled.includes, includes) {
+		return pooled, nil
+	}
+
+	rt := &jsRuntime{
+		includes: includes,
+		ctx:      context.Background(),
+	}
+	vm := setupGojaRuntime(rt)
+	for _, program := range includes {
+		if _, err := vm.RunProgram(program); err != nil {
+			return nil, fmt.Errorf("failed to run included JS file: %w", err)
+		}
+	}
+	jsonParse, ok := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+	if !ok {
+		return nil, fmt.Errorf("JSON.parse is not available")
+	}
+	rt.jsonParse = jsonParse
+
+	global := vm.GlobalObject()
+	rt.globals = make(map[string]goja.Value)
+	for _, key := range global.GetOwnPropertyNames() {
+		rt.globals[key] = global.Get(key)
+	}
+	return rt, nil
+}
+
+// releaseRuntime はスクリプトが追加・変更したグローバル変数を元に戻してランタイムをプールへ返却します。
+// 次のリクエスト（別のユーザーの場合もある）にスクリプトの変数が残らないようにします。
+func releaseRuntime(rt *jsRuntime) {
+	resetGlobals(rt.vm.GlobalObject(), rt.globals)
+	rt.ctx = context.Background()
+	rt.gin = nil
+	runtimePool.Put(rt)
+}
+
+// resetGlobals は global を snapshot の状態に戻します。
+// 追加されたプロパティは削除し、削除できないもの（トップレベルの var や function）は undefined にします。
+func resetGlobals(global *goja.Object, snapshot map[string]goja.Value) {
+	for _, key := range global.GetOwnPropertyNames() {
+		original, ok := snapshot[key]
+		if !ok {
+			if err := global.Delete(key); err != nil || global.Get(key) != nil {
+				global.Set(key, goja.Undefined())
+			}
+			continue
+		}
+		if current := global.Get(key); current != original && (current == nil || !current.SameAs(original)) {
+			global.Set(key, original)
+		}
+	}
+	for key, original := range snapshot {
+		if global.Get(key) == nil {
+			global.Set(key, original)
+		}
+	}
+}
+
+// toJSValue は Go の値を JSON 経由で素の JavaScript の値に変換します。
+func (rt *jsRuntime) toJSValue(value interface{}) (goja.Value, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return rt.jsonParse(goja.Undefined(), rt.vm.ToValue(string(data)))
+}
+
+// runJavaScriptValue はスクリプトを実行します。ctx が終了するとスクリプトは中断されます。
+// c は Cookie 操作などに使う HTTP リクエストで、ws_client や push の実行では nil を渡します。
+func runJavaScriptValue(ctx context.Context, c *gin.Context, scriptPath string, htmlPath string, allParams map[string]interface{}) (result *scriptResult, err error) {
+	// スクリプトのパスを解決してコンパイル（キャッシュ済みならそれを使う）
+	scriptPath = resolvePath(baseDir, scriptPath)
+	start := time.Now()
+	defer func() {
+		recordScriptMetrics(scriptMetricsLabel(scriptPath), time.Since(start), err)
+	}()
+	program, err := compileScriptFile(scriptPath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlCode := ""
+	if strings.TrimSpace(htmlPath) != "" {
+		// HTMLファイルを読み込み
+		htmlPath = resolvePath(baseDir, htmlPath)
+		htmlCodeBytes, err := os.ReadFile(htmlPath)
+		if err != nil {
+			loggerFromContext(ctx).Error("Failed to load HTML file", "path", htmlPath, "error", err)
+			return nil, fmt.Errorf("failed to load HTML file: %v", err)
+		}
+		htmlCode = string(htmlCodeBytes)
+	}
+
+	rt, err := acquireRuntime(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseRuntime(rt)
+
+	// リクエストパラメータはJSON経由で渡す（スクリプトからは素のオブジェクトとして見える）
+	params, err := rt.toJSValue(allParams)
+	if err != nil {
+		return nil, err
+	}
+	request := goja.Null()
+	pathParams := map[string]interface{}{}
+	if c != nil && c.Request != nil {
+		if request, err = rt.toJSValue(buildNyanRequest(c)); err != nil {
+			return nil, err
+		}
+		for _, param := range c.Params {
+			pathParams[param.Key] = param.Value
+		}
+	}
+	pathParamsValue, err := rt.toJSValue(pathParams)
+	if err != nil {
+		return nil, err
+	}
+	rt.vm.Set("nyanAllParams", params)
+	rt.vm.Set("nyanHtmlCode", htmlCode)
+	rt.vm.Set("nyanRequest", request)
+	rt.vm.Set("nyanPathParams", pathParamsValue)
+	rt.ctx = ctx
+	rt.gin = c
+
+	// ctx の終了（タイムアウトなど）でスクリプトを中断する
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		rt.vm.Interrupt(ctx.Err())
+		close(interrupted)
+	})
+	defer func() {
+		if !stop() {
+			// 中断済みのランタイムをプールへ戻す前に中断状態を解除する
+			<-interrupted
+			rt.vm.ClearInterrupt()
+		}
+	}()
+
+	// スクリプトを実行
+	value, err := rt.vm.RunProgram(program)
+	if err != nil {
+		// ネイティブ関数が期限切れで失敗した例外も中断として扱う
+		if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+			err = fmt.Errorf("%w: %v", ctxErr, err)
+		}
+		return nil, err
+	}
+
+	result = &scriptResult{}
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		result.empty = true
+		if value != nil {
+			result.text = value.String()
+		}
+		return result, nil
+	}
+	result.value = value.Export()
+	result.text = value.String()
+	return result, nil
+}
+
+func writeJSResponse(c *gin.Context, result *scriptResult) (bool, error) {
+	if result == nil || result.empty {
+		return false, nil
+	}
+
+	respMap, ok := result.value.(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+
+	status := http.StatusOK
+	if rawStatus, ok := respMap["status"]; ok {
+		if parsed, ok := parseStatusCode(rawStatus); ok {
+			status = parsed
+		}
+	}
+
+	contentType := ""
+	if rawContentType, ok := respMap["contentType"]; ok {
+		if s, ok := rawContentType.(string); ok {
+			contentType = s
+		} else {
+			contentType = fmt.Sprint(rawContentType)
+		}
+	}
+
+	headers := map[string]string{}
+	if rawHeaders, ok := respMap["headers"]; ok {
+		if headerMap, ok := rawHeaders.(map[string]interface{}); ok {
+			for key, value := range headerMap {
+				headers[key] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	bodyBytes, err := jsBodyToBytes(respMap["body"])
+	if err != nil {
+		return true, err
 	}
 
 	for key, value := range headers {
 		c.Writer.Header().Set(key, value)
 	}
 
-	if strings.TrimSpace(contentType) == "" {
-		contentType = "text/html; charset=utf-8"
+	if strings.TrimSpace(contentType) == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	c.Data(status, contentType, bodyBytes)
+	return true, nil
+}
+
+func parseStatusCode(raw interface{}) (int, bool) {
+	switch v := raw.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float32:
+		return int(v), true
+	case float64:
+		return int(v), true
+	case json.Number:
+		parsed, err := v.Int64()
+		if err != nil {
+			return 0, false
+		}
+		return int(parsed), true
+	default:
+		return 0, false
+	}
+}
+
+func jsBodyToBytes(body interface{}) ([]byte, error) {
+	if body == nil {
+		return []byte{}, nil
+	}
+
+	switch v := body.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case []interface{}:
+		return json.Marshal(v)
+	case map[string]interface{}:
+		if encoding, ok := v["encoding"].(string); ok && strings.EqualFold(encoding, "base64") {
+			data, _ := v["data"].(string)
+			if strings.TrimSpace(data) == "" {
+				return []byte{}, nil
+			}
+			decoded, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 body: %w", err)
+			}
+			return decoded, nil
+		}
+		return json.Marshal(v)
+	default:
+		return []byte(fmt.Sprint(v)), nil
+	}
+}
+
+const apiTypeWSClient = "ws_client"
+
+type wsClientConfig struct {
+	name        string
+	scriptPath  string
+	connectURL  string
+	description string
+	timeout     time.Duration
+	logLevel    string
+	keepalive   wsKeepalive
+}
+
+// connectURL が env:XXXX 形式なら環境変数 XXXX で解決する。空や未設定はエラー。
+func resolveConnectURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("connectURL is empty")
+	}
+	if strings.HasPrefix(raw, "env:") {
+		key := strings.TrimPrefix(raw, "env:")
+		if key == "" {
+			return "", fmt.Errorf("connectURL env: prefix is empty")
+		}
+		val := os.Getenv(key)
+		if val == "" {
+			return "", fmt.Errorf("environment variable %s is empty", key)
+		}
+		return val, nil
+	}
+	return raw, nil
+}
+
+// 起動中の ws_client（名前ごと）
+var wsClients = struct {
+	sync.Mutex
+	running map[string]*wsClientHandle
+	stopped bool // 終了処理で停止した後は true（再読み込みでも起動しない）
+}{
+	running: make(map[string]*wsClientHandle),
+}
+
+// wsClientHandle は起動中の ws_client を停止するためのハンドルです。
+type wsClientHandle struct {
+	cfg    wsClientConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// syncWebSocketClients は api.json に定義された ws_client を起動します。
+// 既に起動している ws_client は、定義が変わったものと削除されたものを停止し、変わっていないものはそのままにします。
+func syncWebSocketClients(api APIConfig) error {
+	var firstErr error
+	global := currentConfig().WebSocket
+	desired := make(map[string]wsClientConfig)
+	for name, cfg := range api {
+		if strings.TrimSpace(cfg.Type) != apiTypeWSClient {
+			continue
+		}
+
+		scriptPath := strings.TrimSpace(cfg.Script)
+		connectURLRaw := strings.TrimSpace(cfg.ConnectURL)
+
+		if scriptPath == "" {
+			err := fmt.Errorf("ws_client %s: script is missing", name)
+			slog.Error("Invalid ws_client", "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if connectURLRaw == "" {
+			err := fmt.Errorf("ws_client %s: connectURL is missing", name)
+			slog.Error("Invalid ws_client", "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		connectURL, err := resolveConnectURL(connectURLRaw)
+		if err != nil {
+			slog.Error("Invalid ws_client", "ws_client", name, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		desired[name] = wsClientConfig{
+			name:        name,
+			scriptPath:  scriptPath,
+			connectURL:  connectURL,
+			description: cfg.Description,
+			timeout:     scriptTimeout(cfg),
+			logLevel:    cfg.LogLevel,
+			keepalive:   webSocketKeepalive(global, cfg),
+		}
+	}
+
+	// 停止する接続の終了はロックの外で待つ（終了に時間がかかっても他の処理をブロックしないように）
+	var stopping []*wsClientHandle
+	wsClients.Lock()
+	for name, handle := range wsClients.running {
+		if cfg, ok := desired[name]; ok && cfg == handle.cfg {
+			continue
+		}
+		stopping = append(stopping, handle)
+		delete(wsClients.running, name)
+	}
+	wsClients.Unlock()
+	for _, handle := range stopping {
+		slog.Info("Stopping WebSocket client", "ws_client", handle.cfg.name)
+		handle.cancel()
+	}
+	for _, handle := range stopping {
+		<-handle.done
+	}
+
+	wsClients.Lock()
+	defer wsClients.Unlock()
+	if wsClients.stopped {
+		// 停止の待機中に終了処理が始まった場合は起動しない
+		return firstErr
+	}
+	for name, wsCfg := range desired {
+		if _, ok := wsClients.running[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		handle := &wsClientHandle{cfg: wsCfg, cancel: cancel, done: make(chan struct{})}
+		wsClients.running[name] = handle
+
+		logger := endpointLogger(slog.Default(), wsCfg.name, wsCfg.logLevel)
+		ctx = contextWithLogger(ctx, logger)
+		logger.Info("Starting WebSocket client", "url", wsCfg.connectURL)
+		go func() {
+			defer close(handle.done)
+			runWebSocketClient(ctx, wsCfg)
+		}()
+	}
+
+	return firstErr
+}
+
+// stopWebSocketClients は起動中のすべての ws_client を停止します。以降の syncWebSocketClients では起動しません。
+func stopWebSocketClients() {
+	wsClients.Lock()
+	wsClients.stopped = true
+	wsClients.Unlock()
+	syncWebSocketClients(nil)
+}
+
+// 常時接続を維持し、切断時は指数バックオフで再接続します。ctx が終了すると停止します。
+func runWebSocketClient(ctx context.Context, cfg wsClientConfig) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			addMetric("nyanpui_ws_client_reconnects_total", 1, cfg.name)
+		}
+		err := connectAndListenWebSocket(ctx, cfg)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			loggerFromContext(ctx).Warn("WebSocket client disconnected", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+		}
+	}
+}
+
+func connectAndListenWebSocket(ctx context.Context, cfg wsClientConfig) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, cfg.connectURL, nil)
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+	defer conn.Close()
+
+	// ctx が終了したら close フレームを送って接続を閉じ、読み込みを終わらせる
+	stop := context.AfterFunc(ctx, func() {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "client stopping"),
+			time.Now().Add(time.Second))
+		conn.Close()
+	})
+	defer stop()
+
+	logger := loggerFromContext(ctx)
+	logger.Info("WebSocket client connected")
+	setMetric("nyanpui_ws_client_connected", 1, cfg.name)
+	defer setMetric("nyanpui_ws_client_connected", 0, cfg.name)
+
+	// 相手が応答しない・メッセージが来ない場合は接続を閉じ、読み込みのエラーで再接続させる
+	ka := cfg.keepalive
+	ka.prepareRead(conn)
+	done := make(chan struct{})
+	defer close(done)
+	if ka.pingInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(ka.pingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(defaultWebSocketWriteTimeout)); err != nil {
+						logger.Warn("Failed to send WebSocket client ping", "error", err)
+						conn.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+	var idle *time.Timer
+	var idled atomic.Bool
+	if ka.idleTimeout > 0 {
+		idle = time.AfterFunc(ka.idleTimeout, func() {
+			idled.Store(true)
+			conn.Close()
+		})
+		defer idle.Stop()
+	}
+
+	for {
+		ka.extendRead(conn)
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			if idled.Load() {
+				return fmt.Errorf("no message received for %s (idle_timeout)", ka.idleTimeout)
+			}
+			if isTimeoutError(err) {
+				return fmt.Errorf("no pong received for %s (pong_wait): %w", ka.pongWait, err)
+			}
+			return fmt.Errorf("read error: %w", err)
+		}
+		if idle != nil {
+			idle.Reset(ka.idleTimeout)
+		}
+		if msgType == websocket.CloseMessage {
+			return fmt.Errorf("close message received: %s", string(data))
+		}
+
+		logger.Debug("WebSocket client received message", "type", websocketMessageTypeLabel(msgType), "message", string(data))
+
+		allParams := map[string]interface{}{
+			"api":             cfg.name,
+			"ws_client":       cfg.name,
+			"ws_message_type": websocketMessageTypeLabel(msgType),
+			"ws_message_text": string(data),
+			"ws_connect_url":  cfg.connectURL,
+			"ws_description":  cfg.description,
+		}
+
+		if msgType == websocket.BinaryMessage {
+			allParams["ws_message_base64"] = base64.StdEncoding.EncodeToString(data)
+		}
+
+		if msgType == websocket.TextMessage {
+			var decoded interface{}
+			if err := json.Unmarshal(data, &decoded); err == nil {
+				allParams["ws_message_json"] = decoded
+			}
+		}
+
+		scriptCtx, cancel := context.WithTimeout(ctx, cfg.timeout)
+		result, err := runJavaScript(scriptCtx, nil, cfg.scriptPath, "", allParams)
+		cancel()
+		if err != nil {
+			logger.Error("WebSocket client script error", "error", err)
+			continue
+		}
+
+		trimmed := strings.TrimSpace(result)
+		if trimmed == "" {
+			continue
+		}
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(trimmed)); err != nil {
+			return fmt.Errorf("send error: %w", err)
+		}
+	}
+}
+
+func websocketMessageTypeLabel(t int) string {
+	switch t {
+	case websocket.TextMessage:
+		return "text"
+	case websocket.BinaryMessage:
+		return "binary"
+	case websocket.CloseMessage:
+		return "close"
+	case websocket.PingMessage:
+		return "ping"
+	case websocket.PongMessage:
+		return "pong"
+	default:
+		return fmt.Sprintf("unknown(%d)", t)
+	}
+}
+
+// CORSMiddleware は config.json の cors（api.json でエンドポイントごとに指定した場合はそちら）に従って
+// CORS のヘッダーを設定します。許可した Origin はそのまま Access-Control-Allow-Origin に返します。
+func CORSMiddleware(config Config, api APIConfig) gin.HandlerFunc {
+	defaultPolicy := config.CORS
+	if defaultPolicy == nil {
+		defaultPolicy = defaultCORSConfig
+	}
+	return func(c *gin.Context) {
+		policy := defaultPolicy
+		endpoint, matched := corsEndpoint(c, api)
+		if matched && endpoint.CORS != nil {
+			policy = endpoint.CORS
+		}
+
+		// Origin によってレスポンスが変わるため、キャッシュに Origin ごとに保存させる
+		c.Writer.Header().Add("Vary", "Origin")
+		origin := c.GetHeader("Origin")
+		allowed := origin != "" && policy.allowsOrigin(origin)
+		if allowed {
+			header := c.Writer.Header()
+			header.Set("Access-Control-Allow-Origin", origin)
+			if policy.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(policy.ExposeHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposeHeaders, ", "))
+			}
+		}
+
+		if c.Request.Method == "OPTIONS" {
+			if allowed && c.GetHeader("Access-Control-Request-Method") != "" {
+				header := c.Writer.Header()
+				methods := policy.methods()
+				if matched {
+					methods = corsEndpointMethods(methods, endpoint)
+				}
+				header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				header.Set("Access-Control-Allow-Headers", strings.Join(policy.headers(), ", "))
+				if policy.MaxAge > 0 {
+					header.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+				}
+			}
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// cors を設定していない場合の CORS の設定（すべての Origin を許可し、認証情報は許可しない）
+var defaultCORSConfig = &CORSConfig{AllowOrigins: []string{"*"}}
+
+// CORS の設定で methods / headers を省略した場合の値
+var (
+	defaultCORSMethods = []string{"POST", "OPTIONS", "GET", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization"}
+)
+
+// corsEndpointMethods は CORS で許可するメソッドのうち、エンドポイントの methods でも受け付けるものを返します。
+func corsEndpointMethods(methods []string, endpoint EndpointConfig) []string {
+	if len(endpoint.Methods) == 0 {
+		return methods
+	}
+	allowed := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if isMethodAllowed(endpoint, strings.ToUpper(strings.TrimSpace(method))) {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// corsEndpoint はリクエストの対象の api.json のエンドポイントを返します。
+func corsEndpoint(c *gin.Context, api APIConfig) (EndpointConfig, bool) {
+	fullPath := c.FullPath()
+	if fullPath == "" {
+		return EndpointConfig{}, false
+	}
+	name := strings.TrimPrefix(fullPath, "/")
+	if fullPath == "/" {
+		// "/" は ?api= で指定されたエンドポイント（なければ html）を処理する
+		name = c.Query("api")
+		if name == "" {
+			name = "html"
+		}
+	}
+	endpoint, ok := api[name]
+	return endpoint, ok
+}
+
+// allowsOrigin は origin が許可されているかを返します。
+func (cfg *CORSConfig) allowsOrigin(origin string) bool {
+	return matchOrigin(cfg.AllowOrigins, origin)
+}
+
+// matchOrigin は origin が patterns（"*" や "https://*.example.com" などのワイルドカードを含む）のいずれかに一致するかを返します。
+func matchOrigin(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		if ok, err := path.Match(strings.ToLower(pattern), origin); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebSocketKeepalive は WebSocket の ping / 読み込みの設定を検証します。
+// endpoint の websocket がある場合は config.json の websocket に重ねた設定を検証します。
+func validateWebSocketKeepalive(report *validationReport, target string, global WebSocketConfig, endpoint EndpointConfig) {
+	cfg := global.WebSocketKeepaliveConfig
+	if endpoint.WebSocket != nil {
+		cfg = *endpoint.WebSocket
+	}
+	if cfg.PongWait < 0 {
+		report.errorf(target, "websocket pong_wait must not be negative: %d", cfg.PongWait)
+	}
+	if cfg.IdleTimeout < 0 {
+		report.errorf(target, "websocket idle_timeout must not be negative: %d", cfg.IdleTimeout)
+	}
+	ka := webSocketKeepalive(global, endpoint)
+	if ka.pingInterval > 0 && ka.pongWait <= ka.pingInterval {
+		report.errorf(target, "websocket pong_wait (%s) must be longer than ping_interval (%s)", ka.pongWait, ka.pingInterval)
+	}
+}
+
+// validateOriginPatterns は Origin のパターンの書式を検証します。
+func validateOriginPatterns(report *validationReport, target, field string, patterns []string) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			report.errorf(target, "invalid %s pattern %q: %v", field, pattern, err)
+		}
+	}
+}
+
+func (cfg *CORSConfig) methods() []string {
+	if len(cfg.AllowMethods) == 0 {
+		return defaultCORSMethods
+	}
+	return cfg.AllowMethods
+}
+
+func (cfg *CORSConfig) headers() []string {
+	if len(cfg.AllowHeaders) == 0 {
+		return defaultCORSHeaders
+	}
+	return cfg.AllowHeaders
+}
+
+// validateCORSConfig は CORS の設定を検証します。
+func validateCORSConfig(report *validationReport, target string, cfg *CORSConfig) {
+	if cfg == nil {
+		return
+	}
+	if len(cfg.AllowOrigins) == 0 {
+		report.warnf(target, "cors allow_origins is empty, cross-origin requests are rejected")
+	}
+	validateOriginPatterns(report, target, "cors allow_origins", cfg.AllowOrigins)
+	for _, pattern := range cfg.AllowOrigins {
+		if pattern == "*" && cfg.AllowCredentials {
+			report.warnf(target, "cors allow_credentials with \"*\" allows credentialed requests from any origin")
+		}
+	}
+	if cfg.MaxAge < 0 {
+		report.errorf(target, "cors max_age must not be negative")
+	}
+}
+
+// loadHTMLFile は指定されたHTMLファイルを読み込み、その内容を文字列として返します。
+func loadHTMLFile(filePath string) (string, error) {
+	htmlBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return string(htmlBytes), nil
+}
+
+// スクリプトからの HTTP リクエストに使うクライアント（"" がデフォルト、それ以外は http_client の profiles）
+var httpClients = struct {
+	sync.RWMutex
+	clients map[string]*outgoingClient
+}{
+	clients: map[string]*outgoingClient{"": {client: &http.Client{Timeout: defaultHTTPClientTimeout}}},
+}
+
+// outgoingClient は http_client の 1 つのクライアントと、その再試行・サーキットブレーカーの設定です。
+type outgoingClient struct {
+	name            string
+	client          *http.Client
+	maxResponseSize int64
+	retry           *retryPolicy   // nil の場合は再試行しない
+	breaker         *breakerPolicy // nil の場合はサーキットブレーカーを使わない
+}
+
+// retryPolicy は RetryConfig にデフォルトを補ったものです。
+type retryPolicy struct {
+	maxAttempts         int
+	backoff, maxBackoff time.Duration
+	retryOn             map[int]bool
+}
+
+// breakerPolicy は CircuitBreakerConfig にデフォルトを補ったものです。
+type breakerPolicy struct {
+	threshold    int
+	openDuration time.Duration
+}
+
+// newHTTPClients は http_client の設定からデフォルトと名前付きのクライアントを作成します。
+func newHTTPClients(baseDir string, cfg HTTPClientConfig) (map[string]*outgoingClient, error) {
+	if cfg.FetchAllConcurrency < 0 {
+		return nil, fmt.Errorf("http_client: fetch_all_concurrency must not be negative")
+	}
+	clients := make(map[string]*outgoingClient, len(cfg.Profiles)+1)
+	client, err := newOutgoingClient(baseDir, "", cfg.HTTPClientProfile)
+	if err != nil {
+		return nil, fmt.Errorf("http_client: %w", err)
+	}
+	clients[""] = client
+	for name, profile := range cfg.Profiles {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("http_client: profile name is empty")
+		}
+		client, err := newOutgoingClient(baseDir, name, profile.inherit(cfg.HTTPClientProfile))
+		if err != nil {
+			return nil, fmt.Errorf("http_client profile %s: %w", name, err)
+		}
+		clients[name] = client
+	}
+	return clients, nil
+}
+
+// newOutgoingClient は profile の HTTP クライアントと再試行・サーキットブレーカーの設定を作成します。
+func newOutgoingClient(baseDir, name string, profile HTTPClientProfile) (*outgoingClient, error) {
+	client, err := newHTTPClient(baseDir, profile)
+	if err != nil {
+		return nil, err
+	}
+	if profile.MaxResponseSize < 0 {
+		return nil, fmt.Errorf("max_response_size must not be negative")
+	}
+	oc := &outgoingClient{name: name, client: client, maxResponseSize: defaultHTTPClientMaxResponseSize}
+	if profile.MaxResponseSize > 0 {
+		oc.maxResponseSize = profile.MaxResponseSize
+	}
+
+	if retry := profile.Retry; retry != nil {
+		if retry.MaxAttempts < 0 || retry.Backoff < 0 || retry.MaxBackoff < 0 {
+			return nil, fmt.Errorf("retry values must not be negative")
+		}
+		policy := &retryPolicy{
+			maxAttempts: defaultRetryMaxAttempts,
+			backoff:     defaultRetryBackoff,
+			maxBackoff:  defaultRetryMaxBackoff,
+			retryOn:     map[int]bool{},
+		}
+		if retry.MaxAttempts > 0 {
+			policy.maxAttempts = retry.MaxAttempts
+		}
+		if retry.Backoff > 0 {
+			policy.backoff = time.Duration(retry.Backoff) * time.Millisecond
+		}
+		if retry.MaxBackoff > 0 {
+			policy.maxBackoff = time.Duration(retry.MaxBackoff) * time.Millisecond
+		}
+		retryOn := retry.RetryOn
+		if len(retryOn) == 0 {
+			retryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+		}
+		for _, code := range retryOn {
+			if code < 100 || code > 599 {
+				return nil, fmt.Errorf("retry_on has an invalid status code: %d", code)
+			}
+			policy.retryOn[code] = true
+		}
+		oc.retry = policy
+	}
+
+	if breaker := profile.CircuitBreaker; breaker != nil {
+		if breaker.FailureThreshold < 0 || breaker.OpenTimeout < 0 {
+			return nil, fmt.Errorf("circuit_breaker values must not be negative")
+		}
+		policy := &breakerPolicy{threshold: defaultCircuitBreakerThreshold, openDuration: defaultCircuitBreakerOpenDuration}
+		if breaker.FailureThreshold > 0 {
+			policy.threshold = breaker.FailureThreshold
+		}
+		if breaker.OpenTimeout > 0 {
+			policy.openDuration = time.Duration(breaker.OpenTimeout) * time.Second
+		}
+		oc.breaker = policy
+	}
+	return oc, nil
+}
+
+// inherit は省略された項目を base の値で補った設定を返します。
+func (p HTTPClientProfile) inherit(base HTTPClientProfile) HTTPClientProfile {
+	if p.Timeout == 0 {
+		p.Timeout = base.Timeout
+	}
+	if p.MaxIdleConns == 0 {
+		p.MaxIdleConns = base.MaxIdleConns
+	}
+	if p.MaxIdleConnsPerHost == 0 {
+		p.MaxIdleConnsPerHost = base.MaxIdleConnsPerHost
+	}
+	if p.IdleConnTimeout == 0 {
+		p.IdleConnTimeout = base.IdleConnTimeout
+	}
+	if p.Proxy == "" {
+		p.Proxy = base.Proxy
+	}
+	if p.CAFile == "" {
+		p.CAFile = base.CAFile
+	}
+	if p.CertFile == "" && p.KeyFile == "" {
+		p.CertFile, p.KeyFile = base.CertFile, base.KeyFile
+	}
+	p.InsecureSkipVerify = p.InsecureSkipVerify || base.InsecureSkipVerify
+	if p.MaxResponseSize == 0 {
+		p.MaxResponseSize = base.MaxResponseSize
+	}
+	if p.Retry == nil {
+		p.Retry = base.Retry
+	}
+	if p.CircuitBreaker == nil {
+		p.CircuitBreaker = base.CircuitBreaker
+	}
+	return p
+}
+
+// newHTTPClient は profile の設定で接続を再利用する HTTP クライアントを作成します。
+func newHTTPClient(baseDir string, profile HTTPClientProfile) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = defaultHTTPClientMaxIdleConnsPerHost
+	if profile.MaxIdleConns > 0 {
+		transport.MaxIdleConns = profile.MaxIdleConns
+	}
+	if profile.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = profile.MaxIdleConnsPerHost
+	}
+	if profile.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(profile.IdleConnTimeout) * time.Second
+	}
+
+	switch proxy := strings.TrimSpace(profile.Proxy); proxy {
+	case "":
+		// http.DefaultTransport と同じく環境変数に従う
+	case httpClientProxyDirect:
+		transport.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL: %s", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: profile.InsecureSkipVerify}
+	if profile.CAFile != "" {
+		pem, err := os.ReadFile(resolvePath(baseDir, profile.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file: %s", profile.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (profile.CertFile == "") != (profile.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if profile.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(resolvePath(baseDir, profile.CertFile), resolvePath(baseDir, profile.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := defaultHTTPClientTimeout
+	if profile.Timeout > 0 {
+		timeout = time.Duration(profile.Timeout) * time.Second
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// setHTTPClients はクライアントを差し替え、古いクライアントの待機中の接続を閉じます。
+// サーキットブレーカーの状態は引き継ぎます。
+func setHTTPClients(clients map[string]*outgoingClient) {
+	httpClients.Lock()
+	old := httpClients.clients
+	httpClients.clients = clients
+	httpClients.Unlock()
+	for _, oc := range old {
+		oc.client.CloseIdleConnections()
+	}
+}
+
+// httpClient は名前のクライアントを返します（"" の場合はデフォルト）。
+func httpClient(name string) (*outgoingClient, error) {
+	httpClients.RLock()
+	defer httpClients.RUnlock()
+	client, ok := httpClients.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown http_client profile: %s", name)
+	}
+	return client, nil
+}
+
+// fetchRequest は nyanFetch のリクエストを表します。
+type fetchRequest struct {
+	method    string
+	url       string
+	headers   http.Header
+	body      []byte
+	basicAuth *[2]string // ユーザー名とパスワード（nil の場合は付けない）
+	timeout   time.Duration
+	client    string // http_client の profiles の名前（"" の場合はデフォルト）
+}
+
+// fetchResponse は nyanFetch のレスポンスを表します。
+type fetchResponse struct {
+	status     int
+	statusText string
+	headers    http.Header
+	body       []byte
+}
+
+// toJS は nyanFetch の返り値 {status, statusText, ok, headers, body, json} にします。
+// headers のキーは小文字で、同じ名前のヘッダーは ", " でつなぎます。json は body が JSON でなければ null です。
+func (r *fetchResponse) toJS() map[string]interface{} {
+	headers := make(map[string]interface{}, len(r.headers))
+	for key, values := range r.headers {
+		headers[strings.ToLower(key)] = strings.Join(values, ", ")
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(r.body, &decoded); err != nil {
+		decoded = nil
+	}
+	return map[string]interface{}{
+		"status":     r.status,
+		"statusText": r.statusText,
+		"ok":         r.status >= 200 && r.status < 300,
+		"headers":    headers,
+		"body":       string(r.body),
+		"json":       decoded,
+	}
+}
+
+// newFetchRequest は nyanFetch(url, options) の options を fetchRequest にします。
+// options: {method, query, headers, body, json, form, basicAuth: {username, password}, timeout（秒）, client}
+// body / json / form は 1 つだけ指定できます。
+func newFetchRequest(rawURL string, options map[string]interface{}) (fetchRequest, error) {
+	req := fetchRequest{method: http.MethodGet, url: rawURL, headers: http.Header{}}
+	if strings.TrimSpace(rawURL) == "" {
+		return req, fmt.Errorf("url is required")
+	}
+
+	if method, ok := options["method"].(string); ok && strings.TrimSpace(method) != "" {
+		req.method = strings.ToUpper(strings.TrimSpace(method))
+	}
+
+	if query := options["query"]; query != nil {
+		values, ok := query.(map[string]interface{})
+		if !ok {
+			return req, fmt.Errorf("query must be an object")
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return req, fmt.Errorf("invalid url: %v", err)
+		}
+		q := u.Query()
+		for key, value := range values {
+			for _, v := range fetchParamValues(value) {
+				q.Add(key, v)
+			}
+		}
+		u.RawQuery = q.Encode()
+		req.url = u.String()
+	}
+
+	if headers := options["headers"]; headers != nil {
+		values, ok := headers.(map[string]interface{})
+		if !ok {
+			return req, fmt.Errorf("headers must be an object")
+		}
+		for key, value := range values {
+			for _, v := range fetchParamValues(value) {
+				req.headers.Add(key, v)
+			}
+		}
+	}
+
+	bodies := 0
+	for _, key := range []string{"body", "json", "form"} {
+		if options[key] != nil {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return req, fmt.Errorf("only one of body, json and form can be specified")
+	}
+	switch {
+	case options["body"] != nil:
+		switch body := options["body"].(type) {
+		case string:
+			req.body = []byte(body)
+		case goja.ArrayBuffer:
+			req.body = body.Bytes()
+		case []byte:
+			req.body = body
+		default:
+			return req, fmt.Errorf("body must be a string, ArrayBuffer or Uint8Array (use json for objects)")
+		}
+	case options["json"] != nil:
+		data, err := json.Marshal(options["json"])
+		if err != nil {
+			return req, fmt.Errorf("json: %v", err)
+		}
+		req.body = data
+		if req.headers.Get("Content-Type") == "" {
+			req.headers.Set("Content-Type", "application/json")
+		}
+	case options["form"] != nil:
+		values, ok := options["form"].(map[string]interface{})
+		if !ok {
+			return req, fmt.Errorf("form must be an object")
+		}
+		form := url.Values{}
+		for key, value := range values {
+			for _, v := range fetchParamValues(value) {
+				form.Add(key, v)
+			}
+		}
+		req.body = []byte(form.Encode())
+		if req.headers.Get("Content-Type") == "" {
+			req.headers.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+
+	if auth := options["basicAuth"]; auth != nil {
+		values, ok := auth.(map[string]interface{})
+		if !ok {
+			return req, fmt.Errorf("basicAuth must be an object {username, password}")
+		}
+		username, _ := values["username"].(string)
+		password, _ := values["password"].(string)
+		req.basicAuth = &[2]string{username, password}
+	}
+
+	if timeout := options["timeout"]; timeout != nil {
+		seconds, ok := toFloat64(timeout)
+		if !ok || seconds < 0 {
+			return req, fmt.Errorf("timeout must be a non-negative number of seconds")
+		}
+		req.timeout = time.Duration(seconds * float64(time.Second))
+	}
+
+	if client := options["client"]; client != nil {
+		name, ok := client.(string)
+		if !ok {
+			return req, fmt.Errorf("client must be a string")
+		}
+		req.client = strings.TrimSpace(name)
+	}
+	return req, nil
+}
+
+// fetchParamValues は query・headers・form の値を文字列の配列にします。配列は同じ名前で複数の値になります。
+func fetchParamValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fetchParamValues(item)...)
+		}
+		return values
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return []string{fmt.Sprint(v)}
+		}
+		return []string{string(data)}
+	}
+}
+
+// toFloat64 は goja から取り出した数値を float64 にします。
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// doFetch は HTTP リクエストを送信し、レスポンスを返します。
+// ステータスコードが 2xx 以外でもエラーにはせず、送信や受信に失敗した場合だけエラーを返します。
+// ctx（スクリプトのタイムアウト）と req.timeout の短いほうで打ち切ります。
+// クライアントの設定に従って再試行し、サーキットブレーカーが開いているホストへはすぐにエラーを返します。
+func doFetch(ctx context.Context, req fetchRequest) (*fetchResponse, error) {
+	if req.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.timeout)
+		defer cancel()
+	}
+
+	oc, err := httpClient(req.client)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := newHTTPRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	host := httpReq.URL.Host
+	logger := loggerFromContext(ctx)
+
+	attempts := 1
+	if oc.retry != nil && idempotentMethods[req.method] {
+		attempts = oc.retry.maxAttempts
+	}
+	var breaker *circuitBreaker
+	if oc.breaker != nil {
+		breaker = circuitBreakerFor(oc.label(), host)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if breaker != nil {
+			if err := breaker.allow(oc.breaker, logger); err != nil {
+				addMetric("nyanpui_http_client_rejected_total", 1, oc.label(), host)
+				return nil, err
+			}
+		}
+		if attempt > 1 {
+			if httpReq, err = newHTTPRequest(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := sendHTTPRequest(oc.client, httpReq, oc.maxResponseSize)
+		if breaker != nil {
+			breaker.record(oc.breaker, fetchSucceeded(ctx, resp, err), logger)
+		}
+		if attempt >= attempts || !oc.retry.shouldRetry(ctx, resp, err) {
+			return resp, err
+		}
+
+		wait := oc.retry.delay(attempt, resp)
+		attrs := []any{"client", oc.label(), "host", host, "attempt", attempt, "wait", wait}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		} else {
+			attrs = append(attrs, "status", resp.status)
+		}
+		logger.Warn("Retrying HTTP request", attrs...)
+		addMetric("nyanpui_http_client_retries_total", 1, oc.label(), host)
+		select {
+		case <-ctx.Done():
+			return resp, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fetchAll は reqs を並行して送信し、同じ順に結果を返します。errs[i] が nil でないリクエストは送信せずそのエラーを結果にします。
+// 同時に送信する数は concurrency と http_client.fetch_all_concurrency の小さいほうです（concurrency が 0 以下の場合は後者）。
+func fetchAll(ctx context.Context, reqs []fetchRequest, errs []error, concurrency int) ([]*fetchResponse, []error) {
+	responses := make([]*fetchResponse, len(reqs))
+	results := append([]error(nil), errs...)
+	if limit := currentConfig().HTTPClient.fetchAllConcurrency(); concurrency <= 0 || concurrency > limit {
+		concurrency = limit
+	}
+	concurrency = min(concurrency, len(reqs))
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for i := range reqs {
+		if results[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = fmt.Errorf("error sending request: %v", ctx.Err())
+				return
+			}
+			responses[i], results[i] = doFetch(ctx, reqs[i])
+		}(i)
+	}
+	wg.Wait()
+	return responses, results
+}
+
+// newHTTPRequest は fetchRequest から http.Request を作成します（再試行のたびに本文を読み直せるよう毎回作ります）。
+func newHTTPRequest(ctx context.Context, req fetchRequest) (*http.Request, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, req.url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	for key, values := range req.headers {
+		httpReq.Header[key] = values
+	}
+	if req.basicAuth != nil {
+		httpReq.SetBasicAuth(req.basicAuth[0], req.basicAuth[1])
+	}
+	return httpReq, nil
+}
+
+// sendHTTPRequest はリクエストを 1 回送信し、レスポンスを読み込みます。
+func sendHTTPRequest(client *http.Client, httpReq *http.Request, maxResponseSize int64) (*fetchResponse, error) {
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 上限を超えたかを判定するため 1 バイト多く読む
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if int64(len(data)) > maxResponseSize {
+		return nil, fmt.Errorf("%w: exceeds max_response_size (%d bytes)", errResponseTooLarge, maxResponseSize)
+	}
+	return &fetchResponse{
+		status:     resp.StatusCode,
+		statusText: http.StatusText(resp.StatusCode),
+		headers:    resp.Header,
+		body:       data,
+	}, nil
+}
+
+// 再試行してよい冪等なメソッド
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodTrace:   true,
+}
+
+// label はログやメトリクスに使うクライアントの名前です（デフォルトのクライアントは "default"）。
+func (oc *outgoingClient) label() string {
+	if oc.name == "" {
+		return "default"
+	}
+	return oc.name
+}
+
+// shouldRetry は結果を見て再試行するかを返します。ctx が終了している場合は再試行しません。
+func (p *retryPolicy) shouldRetry(ctx context.Context, resp *fetchResponse, err error) bool {
+	if p == nil || ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// 大きすぎるレスポンスは再試行しても変わらない
+		return !errors.Is(err, errResponseTooLarge)
+	}
+	return p.retryOn[resp.status]
+}
+
+// delay は attempt 回目の後に待つ時間です。backoff を試行ごとに 2 倍にした値（上限 maxBackoff）の半分から全体までの間でランダムに決めます。
+// Retry-After ヘッダー（秒）があればそれに従います（上限 maxBackoff）。
+func (p *retryPolicy) delay(attempt int, resp *fetchResponse) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.headers.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, p.maxBackoff)
+		}
+	}
+	d := p.backoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	return d/2 + time.Duration(mathrand.Int63n(int64(d/2)+1))
+}
+
+// fetchSucceeded はサーキットブレーカーに記録する結果です。
+// 接続の失敗と 5xx は失敗、呼び出し元のタイムアウトやキャンセルはどちらにも数えません（nil）。
+func fetchSucceeded(ctx context.Context, resp *fetchResponse, err error) *bool {
+	var succeeded bool
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return nil
+	case errors.Is(err, errResponseTooLarge):
+		// 接続先は応答しているため成功として扱う
+		succeeded = true
+	case err != nil:
+		succeeded = false
+	default:
+		succeeded = resp.status < 500
+	}
+	return &succeeded
+}
+
+// サーキットブレーカーの状態
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// circuitBreaker はクライアントとホストごとのサーキットブレーカーです。
+type circuitBreaker struct {
+	mu       sync.Mutex
+	client   string
+	host     string
+	state    string
+	failures int       // 連続した失敗の回数
+	openedAt time.Time // open になった時刻
+	trial    bool      // half_open で試しているリクエストがある
+}
+
+// クライアント名とホストごとのサーキットブレーカー（設定を再読み込みしても状態を引き継ぐ）
+var circuitBreakers = struct {
+	sync.Mutex
+	breakers map[[2]string]*circuitBreaker
+}{
+	breakers: make(map[[2]string]*circuitBreaker),
+}
+
+// circuitBreakerFor はクライアントとホストのサーキットブレーカーを返します（なければ作成します）。
+func circuitBreakerFor(client, host string) *circuitBreaker {
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+	key := [2]string{client, host}
+	cb, ok := circuitBreakers.breakers[key]
+	if !ok {
+		cb = &circuitBreaker{client: client, host: host, state: circuitClosed}
+		circuitBreakers.breakers[key] = cb
+	}
+	return cb
+}
+
+// allow はリクエストを送ってよいかを返します。open の間はエラーを返し、
+// open_timeout を過ぎたら half_open にして 1 件だけ通します。
+func (cb *circuitBreaker) allow(policy *breakerPolicy, logger *slog.Logger) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		retryAt := cb.openedAt.Add(policy.openDuration)
+		if time.Now().Before(retryAt) {
+			return fmt.Errorf("circuit breaker is open for %s (client %s) until %s", cb.host, cb.client, retryAt.Format(time.RFC3339))
+		}
+		cb.state = circuitHalfOpen
+		cb.trial = true
+		logger.Info("Circuit breaker half-open, sending a trial request", "client", cb.client, "host", cb.host)
+	case circuitHalfOpen:
+		if cb.trial {
+			return fmt.Errorf("circuit breaker is half-open for %s (client %s), waiting for the trial request", cb.host, cb.client)
+		}
+		cb.trial = true
+	}
+	return nil
+}
+
+// record はリクエストの結果を記録します。succeeded が nil の場合は結果を数えず、half_open の試行だけを終えます。
+func (cb *circuitBreaker) record(policy *breakerPolicy, succeeded *bool, logger *slog.Logger) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.trial = false
+	if succeeded == nil {
+		return
+	}
+	if *succeeded {
+		if cb.state != circuitClosed {
+			logger.Info("Circuit breaker closed", "client", cb.client, "host", cb.host)
+			setMetric("nyanpui_http_client_circuit_open", 0, cb.client, cb.host)
+		}
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == circuitHalfOpen || (cb.state == circuitClosed && cb.failures >= policy.threshold) {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		logger.Warn("Circuit breaker opened", "client", cb.client, "host", cb.host,
+			"failures", cb.failures, "open_timeout", policy.openDuration)
+		setMetric("nyanpui_http_client_circuit_open", 1, cb.client, cb.host)
+	}
+}
+
+// serveCircuitBreakers はサーキットブレーカーの状態を JSON で返します。
+// メトリクスと同じサーバーの metrics.circuits_path で公開します。
+func serveCircuitBreakers(w http.ResponseWriter, r *http.Request) {
+	circuitBreakers.Lock()
+	breakers := make([]*circuitBreaker, 0, len(circuitBreakers.breakers))
+	for _, cb := range circuitBreakers.breakers {
+		breakers = append(breakers, cb)
+	}
+	circuitBreakers.Unlock()
+	sort.Slice(breakers, func(i, j int) bool {
+		if breakers[i].client != breakers[j].client {
+			return breakers[i].client < breakers[j].client
+		}
+		return breakers[i].host < breakers[j].host
+	})
+
+	status := make([]map[string]interface{}, 0, len(breakers))
+	for _, cb := range breakers {
+		cb.mu.Lock()
+		entry := map[string]interface{}{"client": cb.client, "host": cb.host, "state": cb.state, "failures": cb.failures}
+		if cb.state != circuitClosed {
+			entry["opened_at"] = cb.openedAt.Format(time.RFC3339)
+		}
+		cb.mu.Unlock()
+		status = append(status, entry)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"circuit_breakers": status})
+}
+
+// isLegacyGetAPIArgs は引数が以前の nyanGetAPI(url, user, pass) の形かを返します。
+func isLegacyGetAPIArgs(args []goja.Value) bool {
+	if len(args) != 3 {
+		return false
+	}
+	for _, value := range args {
+		if _, ok := value.Export().(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// legacyFetchRequest は nyanGetAPI / nyanJsonAPI の引数（url, data, user, pass, headers）を fetchRequest にします。
+// GET の場合 data はクエリ（オブジェクトまたはクエリ文字列）、POST の場合は JSON の本文（オブジェクトまたは JSON 文字列）です。
+// 以前の nyanGetAPI(url, user, pass) の形（GET で文字列の引数がちょうど 3 つ）は data を空として扱います。
+func legacyFetchRequest(method string, args []goja.Value) (fetchRequest, error) {
+	if method == http.MethodGet && isLegacyGetAPIArgs(args) {
+		args = []goja.Value{args[0], goja.Undefined(), args[1], args[2]}
+	}
+	arg := func(i int) interface{} {
+		if i >= len(args) || goja.IsUndefined(args[i]) || goja.IsNull(args[i]) {
+			return nil
+		}
+		return args[i].Export()
+	}
+
+	options := map[string]interface{}{"method": method}
+	rawURL, _ := arg(0).(string)
+	switch data := arg(1).(type) {
+	case nil:
+	case string:
+		if method == http.MethodGet {
+			if data != "" {
+				separator := "?"
+				if strings.Contains(rawURL, "?") {
+					separator = "&"
+				}
+				rawURL += separator + strings.TrimPrefix(data, "?")
+			}
+		} else {
+			options["body"] = data
+			options["headers"] = map[string]interface{}{"Content-Type": "application/json"}
+		}
+	default:
+		if method == http.MethodGet {
+			options["query"] = data
+		} else {
+			options["json"] = data
+		}
+	}
+	if username, _ := arg(2).(string); username != "" {
+		password, _ := arg(3).(string)
+		options["basicAuth"] = map[string]interface{}{"username": username, "password": password}
+	}
+
+	req, err := newFetchRequest(rawURL, options)
+	if err != nil {
+		return req, err
+	}
+	switch headers := arg(4).(type) {
+	case nil:
+	case map[string]interface{}:
+		for key, value := range headers {
+			req.headers.Set(key, fmt.Sprint(value))
+		}
+	case string:
+		// JSON 文字列のヘッダー
+		var parsed map[string]string
+		if err := json.Unmarshal([]byte(headers), &parsed); err != nil {
+			return req, fmt.Errorf("invalid header JSON: %v", err)
+		}
+		for key, value := range parsed {
+			req.headers.Set(key, value)
+		}
+	default:
+		return req, fmt.Errorf("headers must be an object or JSON string")
+	}
+	return req, nil
+}
+
+// ファイルへのログ出力（終了時に閉じる）
+var fileLogger, accessFileLogger *lumberjack.Logger
+
+// アクセスログの出力先と形式（newRouter で使う）
+var (
+	accessLogWriter    io.Writer = os.Stdout
+	accessLogFormatter gin.LogFormatter
+)
+
+// ログの出力先のハンドラー（エンドポイントごとのレベルはこのハンドラーを包んで設定する）
+var baseLogHandler slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+// ログの設定を有効化する。
+// EnableLogging が true の場合はファイルへ、false の場合は標準出力へ、Format の形式で出力します。
+// アクセスログ（gin）も同じ設定でローテーションします。
+func initLogger(logConfig LogConfig, baseDir string) error {
+	level, err := parseLogLevel(logConfig.Level)
+	if err != nil {
+		return err
+	}
+	formatter, err := newAccessLogFormatter(logConfig.AccessLog.Format)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	accessWriter := w
+	if logConfig.EnableLogging {
+		fileLogger = newRotatingLogger(logConfig, resolvePath(baseDir, logConfig.Filename))
+		w = fileLogger
+		accessWriter = fileLogger
+		if logConfig.AccessLog.Filename != "" {
+			accessFileLogger = newRotatingLogger(logConfig, resolvePath(baseDir, logConfig.AccessLog.Filename))
+			accessWriter = accessFileLogger
+		}
+		if logConfig.Stdout {
+			w = io.MultiWriter(w, os.Stdout)
+			accessWriter = io.MultiWriter(accessWriter, os.Stdout)
+		}
+	}
+	accessLogWriter = accessWriter
+	accessLogFormatter = formatter
+	gin.DefaultWriter = w
+	gin.DefaultErrorWriter = w
+
+	// レベルの判定は levelHandler で行うため、出力先のハンドラーはすべてのレベルを受け付ける
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch strings.ToLower(strings.TrimSpace(logConfig.Format)) {
+	case "", "text":
+		baseLogHandler = slog.NewTextHandler(w, options)
+	case "json":
+		baseLogHandler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format: %s", logConfig.Format)
+	}
+	// log パッケージの出力も slog.Default 経由で同じハンドラーに出力される
+	slog.SetDefault(slog.New(&levelHandler{level: level, inner: baseLogHandler}))
+	return nil
+}
+
+// newRotatingLogger は logConfig のローテーション設定で filename へ出力する lumberjack.Logger を返します。
+func newRotatingLogger(logConfig LogConfig, filename string) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    logConfig.MaxSize,    // megabytes
+		MaxBackups: logConfig.MaxBackups, // number of backups
+		MaxAge:     logConfig.MaxAge,     // days
+		Compress:   logConfig.Compress,
+	}
+}
+
+// closeLogger はファイルへのログ出力を閉じます。
+func closeLogger() {
+	if fileLogger == nil {
+		return
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	for _, logger := range []*lumberjack.Logger{fileLogger, accessFileLogger} {
+		if logger == nil {
+			continue
+		}
+		if err := logger.Close(); err != nil {
+			slog.Error("Failed to close log file", "path", logger.Filename, "error", err)
+		}
+	}
+}
+
+// newAccessLogFormatter はアクセスログの形式に対応する gin.LogFormatter を返します。
+// "gin"（または空）の場合は gin のデフォルトの形式（nil）です。
+func newAccessLogFormatter(format string) (gin.LogFormatter, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "gin":
+		return nil, nil
+	case "combined":
+		return formatCombinedAccessLog, nil
+	case "json":
+		return formatJSONAccessLog, nil
+	}
+	return nil, fmt.Errorf("unknown access log format: %s", format)
+}
+
+// formatCombinedAccessLog は Apache の combined 形式でアクセスログを出力します。
+func formatCombinedAccessLog(param gin.LogFormatterParams) string {
+	user := "-"
+	if param.Request.URL.User != nil {
+		user = param.Request.URL.User.Username()
+	} else if username, _, ok := param.Request.BasicAuth(); ok && username != "" {
+		user = username
+	}
+	size := "-"
+	if param.BodySize > 0 {
+		size = strconv.Itoa(param.BodySize)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %s %q %q\n",
+		param.ClientIP,
+		user,
+		param.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		param.Method+" "+param.Path+" "+param.Request.Proto,
+		param.StatusCode,
+		size,
+		param.Request.Referer(),
+		param.Request.UserAgent(),
+	)
+}
+
+// accessLogEntry は JSON 形式のアクセスログの 1 行です。
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id,omitempty"`
+	Endpoint  string  `json:"endpoint,omitempty"`
+	ClientIP  string  `json:"client_ip"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Bytes     int     `json:"bytes"`
+	LatencyMs float64 `json:"latency_ms"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// formatJSONAccessLog は 1 行 1 JSON の形式でアクセスログを出力します。
+func formatJSONAccessLog(param gin.LogFormatterParams) string {
+	entry := accessLogEntry{
+		Time:      param.TimeStamp.Format(time.RFC3339Nano),
+		ClientIP:  param.ClientIP,
+		Method:    param.Method,
+		Path:      param.Path,
+		Proto:     param.Request.Proto,
+		Status:    param.StatusCode,
+		Bytes:     param.BodySize,
+		LatencyMs: float64(param.Latency.Microseconds()) / 1000,
+		Referer:   param.Request.Referer(),
+		UserAgent: param.Request.UserAgent(),
+		Error:     strings.TrimSpace(param.ErrorMessage),
+	}
+	if entry.Bytes < 0 {
+		entry.Bytes = 0
+	}
+	entry.RequestID, _ = param.Keys[requestIDKey].(string)
+	entry.Endpoint, _ = param.Keys[currentAPINameKey].(string)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return ""
+	}
+	return string(line) + "\n"
+}
+
+// parseLogLevel はログレベルの名前（debug / info / warn / error）を slog.Level に変換します。
+// 空の場合は info です。
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level: %s", name)
+}
+
+// levelHandler は最低レベル未満のログを捨てる slog.Handler です。
+// With で属性を追加しても inner を包んだままにし、あとからレベルだけを差し替えられるようにします。
+type levelHandler struct {
+	level slog.Leveler
+	inner slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.inner.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.inner.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithGroup(name)}
+}
+
+// withLogLevel は logger の最低レベルを level に差し替えたロガーを返します。
+func withLogLevel(logger *slog.Logger, level slog.Level) *slog.Logger {
+	if h, ok := logger.Handler().(*levelHandler); ok {
+		return slog.New(&levelHandler{level: level, inner: h.inner})
+	}
+	return slog.New(&levelHandler{level: level, inner: logger.Handler()})
+}
+
+// context.Context にロガーを保存するキー
+type loggerContextKey struct{}
+
+// contextWithLogger は logger を保存した ctx を返します。
+func contextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// loggerFromContext は ctx に保存されたロガーを返します（なければ slog.Default）。
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+			return logger
+		}
 	}
+	return slog.Default()
+}
 
-	c.Data(status, contentType, bodyBytes)
-	return true, nil
+// requestLogger はリクエストのロガー（request_id などの属性付き）を返します。
+func requestLogger(c *gin.Context) *slog.Logger {
+	if c == nil || c.Request == nil {
+		return slog.Default()
+	}
+	return loggerFromContext(c.Request.Context())
 }
 
-func parseStatusCode(raw interface{}) (int, bool) {
-	switch v := raw.(type) {
-	case int:
-		return v, true
-	case int32:
-		return int(v), true
-	case int64:
-		return int(v), true
-	case float32:
-		return int(v), true
-	case float64:
-		return int(v), true
-	case json.Number:
-		parsed, err := v.Int64()
-		if err != nil {
-			return 0, false
+// setRequestLogger はリクエストのロガーを差し替えます。
+func setRequestLogger(c *gin.Context, logger *slog.Logger) {
+	c.Request = c.Request.WithContext(contextWithLogger(c.Request.Context(), logger))
+}
+
+// requestIDMiddleware はリクエスト ID（X-Request-ID ヘッダー、なければ生成）を
+// レスポンスヘッダーとリクエストのロガーに設定します。
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := strings.TrimSpace(c.GetHeader("X-Request-ID"))
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
 		}
-		return int(parsed), true
-	default:
-		return 0, false
+		c.Set(requestIDKey, requestID)
+		c.Header("X-Request-ID", requestID)
+		setRequestLogger(c, slog.Default().With("request_id", requestID))
+		c.Next()
 	}
 }
 
-func jsBodyToBytes(body interface{}) ([]byte, error) {
-	if body == nil {
-		return []byte{}, nil
+// newRequestID はランダムなリクエスト ID を生成します。
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
 	}
+	return hex.EncodeToString(b)
+}
 
-	switch v := body.(type) {
-	case string:
-		return []byte(v), nil
-	case []byte:
-		return v, nil
-	case []interface{}:
-		return json.Marshal(v)
-	case map[string]interface{}:
-		if encoding, ok := v["encoding"].(string); ok && strings.EqualFold(encoding, "base64") {
-			data, _ := v["data"].(string)
-			if strings.TrimSpace(data) == "" {
-				return []byte{}, nil
-			}
-			decoded, err := base64.StdEncoding.DecodeString(data)
-			if err != nil {
-				return nil, fmt.Errorf("invalid base64 body: %w", err)
+// endpointLogger はエンドポイント名と api.json の log_level を反映したロガーを返します。
+func endpointLogger(logger *slog.Logger, name, logLevel string) *slog.Logger {
+	if logLevel != "" {
+		if level, err := parseLogLevel(logLevel); err == nil {
+			logger = withLogLevel(logger, level)
+		}
+	}
+	return logger.With("endpoint", name)
+}
+
+// scriptConsole はスクリプトの console を返します。ログは ctx のロガーに出力します。
+func scriptConsole(rt *jsRuntime) map[string]func(...interface{}) {
+	logAt := func(level slog.Level) func(...interface{}) {
+		return func(args ...interface{}) {
+			parts := make([]string, len(args))
+			for i, arg := range args {
+				// 文字列以外（オブジェクトなど）は JSON で出力する
+				if text, ok := arg.(string); ok {
+					parts[i] = text
+				} else if encoded, err := json.Marshal(arg); err == nil {
+					parts[i] = string(encoded)
+				} else {
+					parts[i] = fmt.Sprint(arg)
+				}
 			}
-			return decoded, nil
+			message := strings.Join(parts, " ")
+			loggerFromContext(rt.ctx).Log(context.Background(), level, message, "source", "console")
 		}
-		return json.Marshal(v)
-	default:
-		return []byte(fmt.Sprint(v)), nil
+	}
+	return map[string]func(...interface{}){
+		"log":   logAt(slog.LevelInfo),
+		"info":  logAt(slog.LevelInfo),
+		"warn":  logAt(slog.LevelWarn),
+		"error": logAt(slog.LevelError),
+		"debug": logAt(slog.LevelDebug),
 	}
 }
 
-const apiTypeWSClient = "ws_client"
+// ヒストグラムのバケット（秒）
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 
-type wsClientConfig struct {
-	name        string
-	scriptPath  string
-	connectURL  string
-	description string
+// metricFamily は同じ名前のメトリクスをラベルの組み合わせごとにまとめたものです。
+type metricFamily struct {
+	kind   string // "counter"、"gauge" または "histogram"
+	help   string
+	labels []string
+	series map[string]*metricSeries
 }
 
-// connectURL が env:XXXX 形式なら環境変数 XXXX で解決する。空や未設定はエラー。
-func resolveConnectURL(raw string) (string, error) {
-	raw = strings.TrimSpace(raw)
-	if raw == "" {
-		return "", fmt.Errorf("connectURL is empty")
+// metricSeries はラベルの値ごとのメトリクスの値です。
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64 // histogram のみ
+	count       uint64   // histogram のみ
+}
+
+// メトリクス（/metrics で Prometheus のテキスト形式で出力する）
+var metrics = struct {
+	sync.Mutex
+	families map[string]*metricFamily
+}{
+	families: map[string]*metricFamily{
+		"nyanpui_http_requests_total": {
+			kind: "counter", help: "Number of HTTP requests by endpoint and status code.",
+			labels: []string{"endpoint", "status"},
+		},
+		"nyanpui_http_request_duration_seconds": {
+			kind: "histogram", help: "HTTP request latency by endpoint and status code.",
+			labels: []string{"endpoint", "status"},
+		},
+		"nyanpui_script_duration_seconds": {
+			kind: "histogram", help: "JavaScript execution time by script.",
+			labels: []string{"script"},
+		},
+		"nyanpui_script_errors_total": {
+			kind: "counter", help: "Number of failed JavaScript executions by script and reason.",
+			labels: []string{"script", "reason"},
+		},
+		"nyanpui_pushes_total": {
+			kind: "counter", help: "Number of pushes by channel.",
+			labels: []string{"channel"},
+		},
+		"nyanpui_push_messages_total": {
+			kind: "counter", help: "Number of push messages delivered to WebSocket connections by channel.",
+			labels: []string{"channel"},
+		},
+		"nyanpui_push_failures_total": {
+			kind: "counter", help: "Number of push messages that failed to be written by channel.",
+			labels: []string{"channel"},
+		},
+		"nyanpui_websocket_dropped_messages_total": {
+			kind: "counter", help: "Number of WebSocket messages dropped because the send queue was full.",
+			labels: []string{"endpoint"},
+		},
+		"nyanpui_websocket_slow_consumer_disconnects_total": {
+			kind: "counter", help: "Number of WebSocket connections closed because the send queue was full.",
+			labels: []string{"endpoint"},
+		},
+		"nyanpui_websocket_timeouts_total": {
+			kind: "counter", help: "Number of WebSocket connections closed because the peer did not respond (pong) or was idle (idle).",
+			labels: []string{"endpoint", "reason"},
+		},
+		"nyanpui_http_client_retries_total": {
+			kind: "counter", help: "Number of retried outgoing HTTP requests from scripts.",
+			labels: []string{"client", "host"},
+		},
+		"nyanpui_http_client_rejected_total": {
+			kind: "counter", help: "Number of outgoing HTTP requests rejected by an open circuit breaker.",
+			labels: []string{"client", "host"},
+		},
+		"nyanpui_http_client_circuit_open": {
+			kind: "gauge", help: "Whether the circuit breaker for the host is open (1) or not (0).",
+			labels: []string{"client", "host"},
+		},
+		"nyanpui_ws_client_connected": {
+			kind: "gauge", help: "Whether the ws_client is connected (1) or not (0).",
+			labels: []string{"client"},
+		},
+		"nyanpui_ws_client_reconnects_total": {
+			kind: "counter", help: "Number of ws_client reconnect attempts.",
+			labels: []string{"client"},
+		},
+	},
+}
+
+// metricSeriesLocked はラベルの値に対応する metricSeries を返します（なければ作成します）。
+func metricSeriesLocked(name string, labelValues []string) *metricSeries {
+	family := metrics.families[name]
+	if family.series == nil {
+		family.series = make(map[string]*metricSeries)
 	}
-	if strings.HasPrefix(raw, "env:") {
-		key := strings.TrimPrefix(raw, "env:")
-		if key == "" {
-			return "", fmt.Errorf("connectURL env: prefix is empty")
-		}
-		val := os.Getenv(key)
-		if val == "" {
-			return "", fmt.Errorf("environment variable %s is empty", key)
+	key := strings.Join(labelValues, "\xff")
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues}
+		if family.kind == "histogram" {
+			series.buckets = make([]uint64, len(metricsBuckets))
 		}
-		return val, nil
+		family.series[key] = series
 	}
-	return raw, nil
+	return series
 }
 
-// startWebSocketClients は api.json に定義された ws_client を起動します。
-func startWebSocketClients(execDir string) error {
-	var firstErr error
-	for name, cfg := range apiConfig {
-		if strings.TrimSpace(cfg.Type) != apiTypeWSClient {
-			continue
-		}
+// addMetric はカウンターに delta を加算します。
+func addMetric(name string, delta float64, labelValues ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metricSeriesLocked(name, labelValues).value += delta
+}
 
-		scriptPath := strings.TrimSpace(cfg.Script)
-		connectURLRaw := strings.TrimSpace(cfg.ConnectURL)
+// setMetric はゲージに値を設定します。
+func setMetric(name string, value float64, labelValues ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metricSeriesLocked(name, labelValues).value = value
+}
 
-		if scriptPath == "" {
-			err := fmt.Errorf("ws_client %s: script is missing", name)
-			log.Print(err)
-			if firstErr == nil {
-				firstErr = err
-			}
-			continue
-		}
-		if connectURLRaw == "" {
-			err := fmt.Errorf("ws_client %s: connectURL is missing", name)
-			log.Print(err)
-			if firstErr == nil {
-				firstErr = err
-			}
-			continue
+// observeMetric はヒストグラムに経過時間を記録します。
+func observeMetric(name string, elapsed time.Duration, labelValues ...string) {
+	seconds := elapsed.Seconds()
+	metrics.Lock()
+	defer metrics.Unlock()
+	series := metricSeriesLocked(name, labelValues)
+	for i, bound := range metricsBuckets {
+		if seconds <= bound {
+			series.buckets[i]++
 		}
+	}
+	series.count++
+	series.value += seconds
+}
 
-		connectURL, err := resolveConnectURL(connectURLRaw)
-		if err != nil {
-			log.Printf("ws_client %s: %v", name, err)
-			if firstErr == nil {
-				firstErr = err
-			}
-			continue
-		}
+// scriptMetricsLabel はスクリプトのパスをベースディレクトリからの相対パスにします。
+func scriptMetricsLabel(scriptPath string) string {
+	if rel, err := filepath.Rel(baseDir, scriptPath); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return scriptPath
+}
 
-		wsCfg := wsClientConfig{
-			name:        name,
-			scriptPath:  scriptPath,
-			connectURL:  connectURL,
-			description: cfg.Description,
+// recordScriptMetrics はスクリプトの実行時間とエラーを記録します。
+func recordScriptMetrics(scriptPath string, elapsed time.Duration, err error) {
+	observeMetric("nyanpui_script_duration_seconds", elapsed, scriptPath)
+	if err != nil {
+		reason := "error"
+		if isScriptTimeout(err) {
+			reason = "timeout"
 		}
+		addMetric("nyanpui_script_errors_total", 1, scriptPath, reason)
+	}
+}
+
+// metricsMiddleware はリクエスト数とレイテンシを記録します。
+// api.json のエンドポイントはエンドポイント名、それ以外はルートのパスをラベルにします。
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
 
-		log.Printf("Starting WebSocket client %s -> %s", wsCfg.name, wsCfg.connectURL)
-		go runWebSocketClient(wsCfg)
+		endpoint := c.GetString(currentAPINameKey)
+		if endpoint == "" {
+			endpoint = c.FullPath()
+		}
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		if websocket.IsWebSocketUpgrade(c.Request) && c.Writer.Status() == http.StatusOK {
+			// WebSocket はハイジャック後にステータスが記録されないため 101 とし、接続時間は記録しない
+			addMetric("nyanpui_http_requests_total", 1, endpoint, strconv.Itoa(http.StatusSwitchingProtocols))
+			return
+		}
+		addMetric("nyanpui_http_requests_total", 1, endpoint, status)
+		observeMetric("nyanpui_http_request_duration_seconds", time.Since(start), endpoint, status)
 	}
+}
 
-	return firstErr
+// serveMetrics はメトリクスを Prometheus のテキスト形式で出力します。
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
 }
 
-// 常時接続を維持し、切断時は指数バックオフで再接続します。
-func runWebSocketClient(cfg wsClientConfig) {
-	backoff := time.Second
-	for {
-		err := connectAndListenWebSocket(cfg)
-		if err != nil {
-			log.Printf("WebSocket client %s disconnected: %v", cfg.name, err)
-		}
+// writeMetrics はメトリクスを Prometheus のテキスト形式で書き込みます。
+func writeMetrics(w io.Writer) {
+	var b strings.Builder
 
-		time.Sleep(backoff)
-		if backoff < 30*time.Second {
-			backoff *= 2
-			if backoff > 30*time.Second {
-				backoff = 30 * time.Second
+	metrics.Lock()
+	names := make([]string, 0, len(metrics.families))
+	for name := range metrics.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := metrics.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			labels := formatMetricLabels(family.labels, series.labelValues)
+			if family.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", name, labels, formatMetricValue(series.value))
+				continue
+			}
+			bucketNames := append(append([]string{}, family.labels...), "le")
+			bucketValues := append(append([]string{}, series.labelValues...), "")
+			for i, bound := range metricsBuckets {
+				bucketValues[len(bucketValues)-1] = formatMetricValue(bound)
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatMetricLabels(bucketNames, bucketValues), series.buckets[i])
 			}
+			bucketValues[len(bucketValues)-1] = "+Inf"
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatMetricLabels(bucketNames, bucketValues), series.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, labels, formatMetricValue(series.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, labels, series.count)
 		}
 	}
+	metrics.Unlock()
+
+	// WebSocket の接続数は出力時に wsConnections から数える
+	wsConnections.RLock()
+	endpoints := make([]string, 0, len(wsConnections.conns))
+	for endpoint := range wsConnections.conns {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	b.WriteString("# HELP nyanpui_websocket_connections Number of open WebSocket connections by endpoint.\n")
+	b.WriteString("# TYPE nyanpui_websocket_connections gauge\n")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(&b, "nyanpui_websocket_connections%s %d\n",
+			formatMetricLabels([]string{"endpoint"}, []string{endpoint}), len(wsConnections.conns[endpoint]))
+	}
+	wsConnections.RUnlock()
+
+	io.WriteString(w, b.String())
 }
 
-func connectAndListenWebSocket(cfg wsClientConfig) error {
-	conn, _, err := websocket.DefaultDialer.Dial(cfg.connectURL, nil)
-	if err != nil {
-		return fmt.Errorf("dial failed: %w", err)
+// ラベルの値のエスケープ
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatMetricLabels はラベルを {name="value",...} の形式にします。
+func formatMetricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
 	}
-	defer conn.Close()
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := metricLabelEscaper.Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
 
-	log.Printf("WebSocket client %s connected", cfg.name)
+// formatMetricValue は数値を Prometheus のテキスト形式で表します。
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
 
-	for {
-		msgType, data, err := conn.ReadMessage()
-		if err != nil {
-			return fmt.Errorf("read error: %w", err)
-		}
-		if msgType == websocket.CloseMessage {
-			return fmt.Errorf("close message received: %s", string(data))
-		}
+// itemStore は nyanSetItem / nyanGetItem などで使うキーバリューストアです。
+type itemStore interface {
+	Get(key string) (string, bool)
+	// Set は値を保存します。ttl が 0 以下の場合は期限なしです。
+	Set(key, value string, ttl time.Duration) error
+	Remove(key string) error
+	// Keys は prefix で始まる有効なキーをソートして返します。
+	Keys(prefix string) []string
+	Close() error
+}
 
-		log.Printf("ws_client %s received %s: %s", cfg.name, websocketMessageTypeLabel(msgType), string(data))
+type storeItem struct {
+	value     string
+	expiresAt time.Time // ゼロ値は期限なし
+}
 
-		allParams := map[string]interface{}{
-			"api":             cfg.name,
-			"ws_client":       cfg.name,
-			"ws_message_type": websocketMessageTypeLabel(msgType),
-			"ws_message_text": string(data),
-			"ws_connect_url":  cfg.connectURL,
-			"ws_description":  cfg.description,
-		}
+func (item storeItem) expired(now time.Time) bool {
+	return !item.expiresAt.IsZero() && !now.Before(item.expiresAt)
+}
 
-		if msgType == websocket.BinaryMessage {
-			allParams["ws_message_base64"] = base64.StdEncoding.EncodeToString(data)
+// openItemStore は設定に従ってストアを開きます。
+func openItemStore(cfg StorageConfig, baseDir string) (itemStore, error) {
+	switch strings.TrimSpace(cfg.Type) {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "file":
+		if strings.TrimSpace(cfg.Path) == "" {
+			return nil, fmt.Errorf("storage path is required for file storage")
 		}
+		return openFileStore(resolvePath(baseDir, cfg.Path))
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", cfg.Type)
+	}
+}
 
-		if msgType == websocket.TextMessage {
-			var decoded interface{}
-			if err := json.Unmarshal(data, &decoded); err == nil {
-				allParams["ws_message_json"] = decoded
-			}
-		}
+// memoryStore はメモリ上のストアです。
+type memoryStore struct {
+	mu    sync.Mutex
+	items map[string]storeItem
+}
 
-		result, err := runJavaScript(cfg.scriptPath, "", allParams)
-		if err != nil {
-			log.Printf("ws_client %s script error: %v", cfg.name, err)
-			continue
-		}
+func newMemoryStore() *memoryStore {
+	return &memoryStore{items: make(map[string]storeItem)}
+}
 
-		trimmed := strings.TrimSpace(result)
-		if trimmed == "" {
+func (s *memoryStore) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return "", false
+	}
+	if item.expired(time.Now()) {
+		delete(s.items, key)
+		return "", false
+	}
+	return item.value, true
+}
+
+func (s *memoryStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[key] = newStoreItem(value, ttl)
+	return nil
+}
+
+func (s *memoryStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+	return nil
+}
+
+func (s *memoryStore) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keysLocked(prefix)
+}
+
+func (s *memoryStore) keysLocked(prefix string) []string {
+	now := time.Now()
+	keys := []string{}
+	for key, item := range s.items {
+		if item.expired(now) {
+			delete(s.items, key)
 			continue
 		}
-
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(trimmed)); err != nil {
-			return fmt.Errorf("send error: %w", err)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
+	return keys
 }
-
-func websocketMessageTypeLabel(t int) string {
-	switch t {
-	case websocket.TextMessage:
-		return "text"
-	case websocket.BinaryMessage:
-		return "binary"
-	case websocket.CloseMessage:
-		return "close"
-	case websocket.PingMessage:
-		return "ping"
-	case websocket.PongMessage:
-		return "pong"
-	default:
-		return fmt.Sprintf("unknown(%d)", t)
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func newStoreItem(value string, ttl time.Duration) storeItem {
+	item := storeItem{value: value}
+	if ttl > 0 {
+		item.expiresAt = time.Now().Add(ttl)
 	}
+	return item
 }
 
-func CORSMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+// fileStoreCompactThreshold は追記ログをこの件数書き込むごとに圧縮します。
+const fileStoreCompactThreshold = 10000
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
+// storeLogEntry は fileStore の追記ログの 1 行です。
+type storeLogEntry struct {
+	Op        string `json:"op"` // "set" または "remove"
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // UNIX ミリ秒（0 は期限なし）
+}
 
-		c.Next()
+func newStoreLogEntry(key string, item storeItem) storeLogEntry {
+	entry := storeLogEntry{Op: "set", Key: key, Value: item.value}
+	if !item.expiresAt.IsZero() {
+		entry.ExpiresAt = item.expiresAt.UnixMilli()
 	}
+	return entry
 }
 
-// loadHTMLFile は指定されたHTMLファイルを読み込み、その内容を文字列として返します。
-func loadHTMLFile(filePath string) (string, error) {
-	htmlBytes, err := os.ReadFile(filePath)
-	if err != nil {
-		return "", err
-	}
-	return string(htmlBytes), nil
+// fileStore は変更を JSON の追記ログとしてファイルに保存するストアです。
+// 起動時にログを再生して内容を復元し、ログを圧縮します。
+type fileStore struct {
+	memoryStore
+	path     string
+	file     *os.File
+	appended int
 }
 
-func getAPI(url, username, password string) (string, error) {
-	// HTTPクライアントの生成
-	client := &http.Client{}
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{
+		memoryStore: memoryStore{items: make(map[string]storeItem)},
+		path:        path,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	// リクエストの生成
-	req, err := http.NewRequest("GET", url, nil)
+// replay は追記ログを読み込んでメモリ上に復元します。
+func (s *fileStore) replay() error {
+	data, err := os.ReadFile(s.path)
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %v", err)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
-
-	// BASIC認証ヘッダーの設定
-	if username != "" {
-		req.SetBasicAuth(username, password)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry storeLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// 書き込み途中で終了した最終行などは読み飛ばす
+			slog.Warn("Skipping broken storage entry", "path", s.path, "line", i+1, "error", err)
+			continue
+		}
+		switch entry.Op {
+		case "set":
+			item := storeItem{value: entry.Value}
+			if entry.ExpiresAt > 0 {
+				item.expiresAt = time.UnixMilli(entry.ExpiresAt)
+			}
+			s.items[entry.Key] = item
+		case "remove":
+			delete(s.items, entry.Key)
+		}
 	}
+	return nil
+}
 
-	// リクエストの送信
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+// compactLocked は現在の内容だけを書き出したログでファイルを置き換えます。
+func (s *fileStore) compactLocked() error {
+	var buf bytes.Buffer
+	now := time.Now()
+	for key, item := range s.items {
+		if item.expired(now) {
+			delete(s.items, key)
+			continue
+		}
+		line, err := json.Marshal(newStoreLogEntry(key, item))
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
 	}
-	defer resp.Body.Close()
 
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+		return err
 	}
-	return string(body), nil
+	s.file = file
+	s.appended = 0
+	return nil
 }
 
-// POSTリクエストを行うGo関数
-func jsonAPI(url string, jsonData []byte, username, password string, headers map[string]string) (string, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+func (s *fileStore) appendLocked(entry storeLogEntry) error {
+	line, err := json.Marshal(entry)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	// BASIC認証のセットアップ（usernameが空でなければ）
-	if username != "" {
-		basicAuth := username + ":" + password
-		basicAuthEncoded := base64.StdEncoding.EncodeToString([]byte(basicAuth))
-		req.Header.Set("Authorization", "Basic "+basicAuthEncoded)
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write storage file %s: %w", s.path, err)
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	// 追加のヘッダーが指定されていれば設定（複数指定可能）
-	if headers != nil {
-		for key, value := range headers {
-			req.Header.Set(key, value)
+	s.appended++
+	if s.appended >= fileStoreCompactThreshold {
+		if err := s.compactLocked(); err != nil {
+			slog.Error("Failed to compact storage file", "path", s.path, "error", err)
 		}
 	}
+	return nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+func (s *fileStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := newStoreItem(value, ttl)
+	if err := s.appendLocked(newStoreLogEntry(key, item)); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	s.items[key] = item
+	return nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+func (s *fileStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[key]; !ok {
+		return nil
+	}
+	if err := s.appendLocked(storeLogEntry{Op: "remove", Key: key}); err != nil {
+		return err
 	}
-	return string(body), nil
+	delete(s.items, key)
+	return nil
 }
 
-// ログの設定を有効化する。
-func initLogger(logConfig LogConfig, baseDir string) {
-	logFile := resolvePath(baseDir, logConfig.Filename)
-	if logConfig.EnableLogging {
-		log.SetOutput(&lumberjack.Logger{
-			Filename:   logFile,
-			MaxSize:    logConfig.MaxSize,    // megabytes
-			MaxBackups: logConfig.MaxBackups, // number of backups
-			MaxAge:     logConfig.MaxAge,     // days
-			Compress:   logConfig.Compress,
-		})
-	} else {
-		// ログを無効にする場合は、標準出力を無効にする（例: io.Discard へ出力する）
-		log.SetOutput(io.Discard)
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
 	}
+	err := s.file.Close()
+	s.file = nil
+	return err
 }
 
 // setupGojaRuntime は goja のランタイムをセットアップします。
-func setupGojaRuntime() *goja.Runtime {
+// 登録する関数は rt.ctx を参照するため、実行中のスクリプトのコンテキストが使われます。
+func setupGojaRuntime(rt *jsRuntime) *goja.Runtime {
 	vm := goja.New()
+	rt.vm = vm
+	if size := currentConfig().ScriptMaxCallStackSize; size > 0 {
+		vm.SetMaxCallStackSize(size)
+	}
 
-	// getAPI 関数の登録
-	vm.Set("nyanGetAPI", func(call goja.FunctionCall) goja.Value {
-		if len(call.Arguments) < 3 {
-			return vm.ToValue("")
+	// nyanFetch(url, options) は HTTP リクエストを送信し、{status, statusText, ok, headers, body, json} を返します。
+	// 2xx 以外のステータスも返り値で受け取り、送信に失敗した場合だけ例外にします。
+	vm.Set("nyanFetch", func(call goja.FunctionCall) goja.Value {
+		options, _ := call.Argument(1).Export().(map[string]interface{})
+		if options == nil && !goja.IsUndefined(call.Argument(1)) && !goja.IsNull(call.Argument(1)) {
+			panic(vm.NewTypeError("nyanFetch: options must be an object"))
 		}
-		url := call.Argument(0).String()
-		username := call.Argument(1).String()
-		password := call.Argument(2).String()
-
-		result, err := getAPI(url, username, password)
+		if goja.IsUndefined(call.Argument(0)) || goja.IsNull(call.Argument(0)) {
+			panic(vm.NewTypeError("nyanFetch: url is required"))
+		}
+		req, err := newFetchRequest(call.Argument(0).String(), options)
 		if err != nil {
-			log.Println("getAPI error:", err)
-			return vm.ToValue("")
+			panic(vm.NewTypeError("nyanFetch: " + err.Error()))
 		}
-		return vm.ToValue(result)
+		resp, err := doFetch(rt.ctx, req)
+		if err != nil {
+			panic(vm.ToValue(err.Error()))
+		}
+		return vm.ToValue(resp.toJS())
 	})
 
-	// jsonAPI 関数の登録
-	vm.Set("nyanJsonAPI", func(call goja.FunctionCall) goja.Value {
-		url := call.Argument(0).String()
-		jsonData := call.Argument(1).String()
-		username := call.Argument(2).String()
-		password := call.Argument(3).String()
-
-		// 第5引数：ヘッダー情報（オブジェクトまたはJSON文字列）
-		var headers map[string]string
-		if len(call.Arguments) >= 5 {
-			// まずは、GojaのExportを使って直接オブジェクトとして取り出す
-			if obj, ok := call.Argument(4).Export().(map[string]interface{}); ok {
-				headers = make(map[string]string)
-				for key, value := range obj {
-					if s, ok := value.(string); ok {
-						headers[key] = s
-					} else {
-						// 文字列以外なら fmt.Sprintで文字列化
-						headers[key] = fmt.Sprint(value)
-					}
-				}
-			} else {
-				// オブジェクトとして取得できなければ、JSON文字列として処理する
-				headerJSON := call.Argument(4).String()
-				if err := json.Unmarshal([]byte(headerJSON), &headers); err != nil {
-					panic(vm.ToValue("Invalid header JSON: " + err.Error()))
-				}
+	// nyanFetchAll([requests], {timeout, concurrency}) は複数のリクエストを並行して送信し、結果の配列を同じ順に返します。
+	// requests の各要素は URL の文字列か nyanFetch の options に url を加えたオブジェクトです。
+	// 失敗したリクエストは例外にせず {ok: false, error: "..."} を返します。
+	vm.Set("nyanFetchAll", func(call goja.FunctionCall) goja.Value {
+		entries, ok := call.Argument(0).Export().([]interface{})
+		if !ok {
+			panic(vm.NewTypeError("nyanFetchAll: requests must be an array"))
+		}
+		options, _ := call.Argument(1).Export().(map[string]interface{})
+
+		ctx := rt.ctx
+		if timeout := options["timeout"]; timeout != nil {
+			seconds, ok := toFloat64(timeout)
+			if !ok || seconds < 0 {
+				panic(vm.NewTypeError("nyanFetchAll: timeout must be a non-negative number of seconds"))
+			}
+			if seconds > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds*float64(time.Second)))
+				defer cancel()
+			}
+		}
+		concurrency := 0
+		if value, ok := toFloat64(options["concurrency"]); ok {
+			concurrency = int(value)
+		}
+
+		reqs := make([]fetchRequest, len(entries))
+		errs := make([]error, len(entries))
+		for i, entry := range entries {
+			switch entry := entry.(type) {
+			case string:
+				reqs[i], errs[i] = newFetchRequest(entry, nil)
+			case map[string]interface{}:
+				rawURL, _ := entry["url"].(string)
+				reqs[i], errs[i] = newFetchRequest(rawURL, entry)
+			default:
+				errs[i] = fmt.Errorf("request must be a URL string or an object with url")
+			}
+		}
+
+		responses, errs := fetchAll(ctx, reqs, errs, concurrency)
+		results := make([]interface{}, len(entries))
+		for i := range entries {
+			if errs[i] != nil {
+				results[i] = map[string]interface{}{"ok": false, "error": errs[i].Error()}
+				continue
+			}
+			results[i] = responses[i].toJS()
+		}
+		return vm.ToValue(results)
+	})
+
+	// nyanGetAPI(url, sendData, user, pass, headers) は GET の結果の本文を返します（失敗した場合は空文字列）。
+	vm.Set("nyanGetAPI", func(call goja.FunctionCall) goja.Value {
+		req, err := legacyFetchRequest(http.MethodGet, call.Arguments)
+		if err == nil {
+			var resp *fetchResponse
+			if resp, err = doFetch(rt.ctx, req); err == nil {
+				return vm.ToValue(string(resp.body))
 			}
 		}
+		loggerFromContext(rt.ctx).Error("nyanGetAPI failed", "error", err)
+		return vm.ToValue("")
+	})
 
-		result, err := jsonAPI(url, []byte(jsonData), username, password, headers)
+	// nyanJsonAPI(url, jsonData, user, pass, headers) は JSON を POST した結果の本文を返します（失敗した場合は例外）。
+	vm.Set("nyanJsonAPI", func(call goja.FunctionCall) goja.Value {
+		req, err := legacyFetchRequest(http.MethodPost, call.Arguments)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
-		return vm.ToValue(result)
+		resp, err := doFetch(rt.ctx, req)
+		if err != nil {
+			panic(vm.ToValue(err.Error()))
+		}
+		return vm.ToValue(string(resp.body))
 	})
 
 	// getCookie, setCookie, setItem, getItem も同様に登録する
@@ -1065,10 +5181,10 @@ func setupGojaRuntime() *goja.Runtime {
 			return vm.ToValue("")
 		}
 		cookieName := call.Argument(0).String()
-		if ginContext != nil {
-			cookieValue, err := ginContext.Cookie(cookieName)
+		if rt.gin != nil {
+			cookieValue, err := rt.gin.Cookie(cookieName)
 			if err != nil {
-				log.Printf("Error retrieving cookie: %v", err)
+				loggerFromContext(rt.ctx).Debug("Error retrieving cookie", "error", err)
 				return vm.ToValue("")
 			}
 			return vm.ToValue(cookieValue)
@@ -1082,22 +5198,29 @@ func setupGojaRuntime() *goja.Runtime {
 		}
 		cookieName := call.Argument(0).String()
 		cookieValue := call.Argument(1).String()
-		if ginContext != nil {
-			ginContext.SetCookie(cookieName, cookieValue, 3600, "/", "", false, true)
-			log.Printf("Set-Cookie: %s=%s", cookieName, cookieValue)
+		if rt.gin != nil {
+			rt.gin.SetCookie(cookieName, cookieValue, 3600, "/", "", false, true)
+			loggerFromContext(rt.ctx).Debug("Set-Cookie", "name", cookieName)
 		} else {
-			log.Println("ginContext is not set")
+			loggerFromContext(rt.ctx).Warn("nyanSetCookie: no HTTP request is bound to this script")
 		}
 		return vm.ToValue(nil)
 	})
 
+	// 第3引数で有効期限（秒）を指定できる
 	vm.Set("nyanSetItem", func(call goja.FunctionCall) goja.Value {
 		if len(call.Arguments) < 2 {
 			return vm.ToValue(nil)
 		}
 		key := call.Argument(0).String()
 		value := call.Argument(1).String()
-		storage[key] = value
+		var ttl time.Duration
+		if len(call.Arguments) >= 3 && !goja.IsUndefined(call.Argument(2)) && !goja.IsNull(call.Argument(2)) {
+			ttl = time.Duration(call.Argument(2).ToFloat() * float64(time.Second))
+		}
+		if err := storage.Set(key, value, ttl); err != nil {
+			panic(vm.ToValue(err.Error()))
+		}
 		return vm.ToValue(nil)
 	})
 
@@ -1106,12 +5229,67 @@ func setupGojaRuntime() *goja.Runtime {
 			return vm.ToValue(nil)
 		}
 		key := call.Argument(0).String()
-		if val, ok := storage[key]; ok {
+		if val, ok := storage.Get(key); ok {
 			return vm.ToValue(val)
 		}
 		return vm.ToValue(nil)
 	})
 
+	vm.Set("nyanRemoveItem", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 1 {
+			return vm.ToValue(nil)
+		}
+		if err := storage.Remove(call.Argument(0).String()); err != nil {
+			panic(vm.ToValue(err.Error()))
+		}
+		return vm.ToValue(nil)
+	})
+
+	vm.Set("nyanListKeys", func(call goja.FunctionCall) goja.Value {
+		prefix := ""
+		if len(call.Arguments) >= 1 && !goja.IsUndefined(call.Argument(0)) && !goja.IsNull(call.Argument(0)) {
+			prefix = call.Argument(0).String()
+		}
+		keys := storage.Keys(prefix)
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = key
+		}
+		return vm.NewArray(values...)
+	})
+
+	vm.Set("nyanSaveUpload", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 2 {
+			panic(vm.NewTypeError("nyanSaveUploadには2つの引数（ファイル, 保存先パス）が必要です"))
+		}
+		file, ok := call.Argument(0).Export().(map[string]interface{})
+		if !ok {
+			panic(vm.NewTypeError("nyanSaveUpload: file must be an uploaded file object"))
+		}
+		saved, err := saveUpload(rt.gin, baseDir, file, call.Argument(1).String())
+		if err != nil {
+			panic(vm.ToValue("nyanSaveUpload: " + err.Error()))
+		}
+		return vm.ToValue(saved)
+	})
+
+	// nyanPush(channel, message, filter) は channel に接続している WebSocket へ送信し、送信できた数を返す
+	vm.Set("nyanPush", func(call goja.FunctionCall) goja.Value {
+		channel := strings.TrimSpace(call.Argument(0).String())
+		if goja.IsUndefined(call.Argument(0)) || channel == "" {
+			panic(vm.NewTypeError("nyanPush: channel is required"))
+		}
+		messageType, data, err := pushPayload(call.Argument(1))
+		if err != nil {
+			panic(vm.NewTypeError("nyanPush: " + err.Error()))
+		}
+		match, err := newPushFilter(call.Argument(2).Export())
+		if err != nil {
+			panic(vm.NewTypeError("nyanPush: " + err.Error()))
+		}
+		return vm.ToValue(pushMessage(loggerFromContext(rt.ctx), channel, messageType, data, match))
+	})
+
 	vm.Set("nyanGetFile", nyanGetFile(vm))
 	vm.Set("nyanReadFileB64", nyanReadFileB64(vm))
 	vm.Set("nyanCallMe", func(call goja.FunctionCall) goja.Value {
@@ -1137,13 +5315,13 @@ func setupGojaRuntime() *goja.Runtime {
 			}
 		}
 		if strings.TrimSpace(apiName) == "" {
-			apiName = resolveCurrentAPINameFromContext(ginContext)
+			apiName = resolveCurrentAPINameFromContext(rt.gin)
 		}
 		if strings.TrimSpace(apiName) == "" {
 			panic(vm.ToValue("nyanCallMe: api is required"))
 		}
 
-		result, err := callNyanAPIFromVM(apiName, params)
+		result, err := callNyanAPIFromVM(rt.ctx, rt.gin, apiName, params)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
@@ -1153,104 +5331,235 @@ func setupGojaRuntime() *goja.Runtime {
 		return vm.ToValue(result)
 	})
 
-	// console.log の登録
-	console := map[string]func(...interface{}){
-		"log": func(args ...interface{}) {
-			log.Println(args...)
-		},
-	}
-	vm.Set("console", console)
+	// console.log などの登録（レベルごとにリクエストのロガーへ出力）
+	vm.Set("console", scriptConsole(rt))
 
+	// nyanHostExec(command, options) はホストのコマンドを実行し、{success, exitCode, stdout, stderr, timedOut, truncated, error} を返します。
+	// command は文字列（sh -c / cmd /c で実行）または argv の配列（シェルを経由しない）です。
 	vm.Set("nyanHostExec", func(call goja.FunctionCall) goja.Value {
-		if len(call.Arguments) < 1 {
-			return vm.ToValue(`{"success":false,"exitCode":0,"stdout":"","stderr":"No command provided"}`)
+		cfg := currentConfig().HostExec
+		if !cfg.enabled() {
+			panic(vm.ToValue("nyanHostExec is disabled by host_exec.enabled"))
+		}
+		argv, err := hostExecArgv(call.Argument(0).Export())
+		if err != nil {
+			panic(vm.NewTypeError("nyanHostExec: " + err.Error()))
+		}
+		if !cfg.allows(argv[0]) {
+			panic(vm.ToValue("nyanHostExec: command is not allowed by host_exec.allowed_commands: " + argv[0]))
+		}
+		options, _ := call.Argument(1).Export().(map[string]interface{})
+		opts, err := newExecOptions(cfg, options)
+		if err != nil {
+			panic(vm.NewTypeError("nyanHostExec: " + err.Error()))
+		}
+
+		ctx := rt.ctx
+		if opts.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+			defer cancel()
+		}
+		result, err := runCommand(ctx, opts, argv[0], argv[1:]...)
+		if err != nil {
+			loggerFromContext(rt.ctx).Warn("nyanHostExec failed", "command", argv[0], "error", err)
 		}
-		cmdLine := call.Argument(0).String()
-		outJSON := execGoja(cmdLine)
-		return vm.ToValue(outJSON)
+		return execResultValue(vm, result)
 	})
 
 	return vm
 }
 
-// execGoja は OS コマンドを実行して結果を JSON 文字列で返す例
-func execGoja(commandLine string) string {
-	var cmdStr string
-	var args []string
+// hostExecArgv は nyanHostExec の command を argv にします。文字列はシェルで実行します。
+func hostExecArgv(command interface{}) ([]string, error) {
+	switch command := command.(type) {
+	case string:
+		if strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("no command provided")
+		}
+		if runtime.GOOS == "windows" {
+			return []string{"cmd", "/c", command}, nil
+		}
+		return []string{"sh", "-c", command}, nil
+	case []interface{}:
+		if len(command) == 0 {
+			return nil, fmt.Errorf("no command provided")
+		}
+		argv := make([]string, len(command))
+		for i, arg := range command {
+			text, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("argv must be an array of strings")
+			}
+			argv[i] = text
+		}
+		if strings.TrimSpace(argv[0]) == "" {
+			return nil, fmt.Errorf("no command provided")
+		}
+		return argv, nil
+	default:
+		return nil, fmt.Errorf("command must be a string or an array of strings")
+	}
+}
+
+// execOptions は nyanHostExec のオプションです。
+type execOptions struct {
+	dir       string
+	env       []string // os.Environ() に追加する "KEY=VALUE"
+	stdin     *string
+	timeout   time.Duration
+	maxOutput int64
+}
 
-	if runtime.GOOS == "windows" {
-		cmdStr = "cmd"
-		args = []string{"/c", commandLine}
-	} else {
-		cmdStr = "sh"
-		args = []string{"-c", commandLine}
+// newExecOptions は nyanHostExec の options {cwd, env, stdin, timeout（秒）, maxOutputSize} を host_exec の設定と合わせます。
+func newExecOptions(cfg HostExecConfig, options map[string]interface{}) (execOptions, error) {
+	opts := execOptions{maxOutput: defaultHostExecMaxOutputSize}
+	if cfg.Timeout > 0 {
+		opts.timeout = time.Duration(cfg.Timeout) * time.Second
 	}
-	result, err := runCommand(cmdStr, args...)
-	if err != nil {
-		// エラーが発生しても ExecResult 自体は返す
-		// エラー詳細は result.Stderr や ExitCode に含まれる
+	if cfg.MaxOutputSize > 0 {
+		opts.maxOutput = cfg.MaxOutputSize
+	}
+
+	if cwd := options["cwd"]; cwd != nil {
+		dir, ok := cwd.(string)
+		if !ok {
+			return opts, fmt.Errorf("cwd must be a string")
+		}
+		opts.dir = resolvePath(baseDir, dir)
+	}
+	if env := options["env"]; env != nil {
+		values, ok := env.(map[string]interface{})
+		if !ok {
+			return opts, fmt.Errorf("env must be an object")
+		}
+		for key, value := range values {
+			if key == "" || strings.ContainsAny(key, "=\x00") {
+				return opts, fmt.Errorf("invalid env name: %q", key)
+			}
+			opts.env = append(opts.env, key+"="+strings.Join(fetchParamValues(value), ","))
+		}
+		sort.Strings(opts.env)
+	}
+	if stdin := options["stdin"]; stdin != nil {
+		text, ok := stdin.(string)
+		if !ok {
+			return opts, fmt.Errorf("stdin must be a string")
+		}
+		opts.stdin = &text
+	}
+	if timeout := options["timeout"]; timeout != nil {
+		seconds, ok := toFloat64(timeout)
+		if !ok || seconds < 0 {
+			return opts, fmt.Errorf("timeout must be a non-negative number of seconds")
+		}
+		if seconds > 0 {
+			opts.timeout = time.Duration(seconds * float64(time.Second))
+		}
 	}
+	if size := options["maxOutputSize"]; size != nil {
+		value, ok := toFloat64(size)
+		if !ok || value <= 0 {
+			return opts, fmt.Errorf("maxOutputSize must be a positive number of bytes")
+		}
+		// host_exec.max_output_size より大きくはできない
+		opts.maxOutput = min(int64(value), opts.maxOutput)
+	}
+	return opts, nil
+}
+
+// execResultValue は ExecResult を JavaScript のオブジェクトにします。
+// 以前の JSON 文字列を返す形式と互換にするため、toString() は JSON を返します（JSON.parse(result) も使えます）。
+func execResultValue(vm *goja.Runtime, result *ExecResult) goja.Value {
 	data, _ := json.Marshal(result)
-	return string(data)
+	obj := vm.NewObject()
+	obj.Set("success", result.Success)
+	obj.Set("exitCode", result.ExitCode)
+	obj.Set("stdout", result.Stdout)
+	obj.Set("stderr", result.Stderr)
+	obj.Set("timedOut", result.TimedOut)
+	obj.Set("truncated", result.Truncated)
+	if result.Error != "" {
+		obj.Set("error", result.Error)
+	}
+	obj.DefineDataProperty("toString", vm.ToValue(func(goja.FunctionCall) goja.Value {
+		return vm.ToValue(string(data))
+	}), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
+	return obj
 }
 
-// runCommand は OS コマンドを実行し、ExecResult を返す
-func runCommand(command string, args ...string) (*ExecResult, error) {
-	cmd := exec.Command(command, args...)
+// limitedBuffer は max バイトまでを保持し、それ以降は捨てる io.Writer です（プロセスへは書き込めたことにする）。
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
 
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, err
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - int64(b.buf.Len()); int64(len(p)) > remaining {
+		b.truncated = true
+		b.buf.Write(p[:max(remaining, 0)])
+		return len(p), nil
 	}
+	return b.buf.Write(p)
+}
 
-	if err := cmd.Start(); err != nil {
-		return nil, err
+// runCommand は OS コマンドを実行し、ExecResult を返します。
+// ctx が終了した場合（タイムアウト）はプロセスを子孫ごと停止します。起動できなかった場合も ExecResult を返します。
+func runCommand(ctx context.Context, opts execOptions, command string, args ...string) (*ExecResult, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessTree(cmd.Process)
 	}
+	// 停止後も孫プロセスが出力をつかんだままの場合に待ち続けない
+	cmd.WaitDelay = time.Second
+	cmd.Dir = opts.dir
+	if len(opts.env) > 0 {
+		cmd.Env = append(os.Environ(), opts.env...)
+	}
+	if opts.stdin != nil {
+		cmd.Stdin = strings.NewReader(*opts.stdin)
+	}
+	stdoutBuf := &limitedBuffer{max: opts.maxOutput}
+	stderrBuf := &limitedBuffer{max: opts.maxOutput}
+	cmd.Stdout = stdoutBuf
+	cmd.Stderr = stderrBuf
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		io.Copy(&stdoutBuf, stdoutPipe)
-	}()
-	go func() {
-		defer wg.Done()
-		io.Copy(&stderrBuf, stderrPipe)
-	}()
-	wg.Wait()
-
-	execErr := cmd.Wait()
+	execErr := cmd.Run()
 
 	// CP932 -> UTF-8 変換（Windows なら）
-	stdoutStr := stdoutBuf.String()
-	stderrStr := stderrBuf.String()
+	stdoutStr := stdoutBuf.buf.String()
+	stderrStr := stderrBuf.buf.String()
 	if runtime.GOOS == "windows" {
-		if converted, err := cp932ToUTF8(stdoutBuf.Bytes()); err == nil {
+		if converted, err := cp932ToUTF8(stdoutBuf.buf.Bytes()); err == nil {
 			stdoutStr = converted
 		}
-		if converted, err := cp932ToUTF8(stderrBuf.Bytes()); err == nil {
+		if converted, err := cp932ToUTF8(stderrBuf.buf.Bytes()); err == nil {
 			stderrStr = converted
 		}
 	}
 
 	result := &ExecResult{
-		Success:  true,
-		ExitCode: 0,
-		Stdout:   stdoutStr,
-		Stderr:   stderrStr,
+		Success:   true,
+		ExitCode:  0,
+		Stdout:    stdoutStr,
+		Stderr:    stderrStr,
+		Truncated: stdoutBuf.truncated || stderrBuf.truncated,
 	}
 	if execErr != nil {
-		if exitErr, ok := execErr.(*exec.ExitError); ok {
-			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-				result.ExitCode = status.ExitStatus()
-			}
-		}
 		result.Success = false
+		result.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(execErr, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		} else {
+			result.Error = execErr.Error()
+		}
+		if ctx.Err() != nil {
+			result.TimedOut = true
+			result.Error = fmt.Sprintf("command stopped: %v", ctx.Err())
+		}
 		return result, execErr
 	}
 	return result, nil
@@ -1269,17 +5578,19 @@ func cp932ToUTF8(data []byte) (string, error) {
 // handleNyan は /nyan へのリクエストを処理します。
 func handleNyan(c *gin.Context) {
 	apis := make(map[string]ApiData)
-	for apiName, cfg := range apiConfig {
+	for apiName, cfg := range currentAPIConfig() {
 		apis[apiName] = ApiData{
 			Description: cfg.Description,
 			Push:        cfg.Push,
+			Methods:     cfg.Methods,
 		}
 	}
 
+	config := currentConfig()
 	response := NyanResponse{
-		Name:    globalConfig.Name,
-		Profile: globalConfig.Profile,
-		Version: globalConfig.Version,
+		Name:    config.Name,
+		Profile: config.Profile,
+		Version: config.Version,
 		Apis:    apis,
 	}
 
@@ -1294,13 +5605,11 @@ func nyanGetFile(vm *goja.Runtime) func(call goja.FunctionCall) goja.Value {
 		}
 		relativePath := call.Arguments[0].String()
 
-		// 実行中のバイナリのディレクトリからの相対パスに解決
-		exePath, err := os.Executable()
+		// ベースディレクトリ（デフォルトは実行ファイルのディレクトリ）からの相対パスに解決
+		fullPath, err := resolveScriptReadPath(baseDir, relativePath)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
-		exeDir := filepath.Dir(exePath)
-		fullPath := filepath.Join(exeDir, relativePath)
 
 		// ディレクトリ指定なら null
 		if fi, err := os.Stat(fullPath); err == nil && fi.IsDir() {
@@ -1329,13 +5638,12 @@ func nyanReadFileB64(vm *goja.Runtime) func(call goja.FunctionCall) goja.Value {
 		}
 		path := call.Arguments[0].String()
 
-		abs := path
-		if !filepath.IsAbs(path) {
-			wd, _ := os.Getwd()
-			abs = filepath.Join(wd, path)
+		// nyanGetFile と同じくベースディレクトリからの相対パスに解決
+		fullPath, err := resolveScriptReadPath(baseDir, path)
+		if err != nil {
+			panic(vm.ToValue(err.Error()))
 		}
-
-		content, err := os.ReadFile(abs)
+		content, err := os.ReadFile(fullPath)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
@@ -1345,8 +5653,22 @@ func nyanReadFileB64(vm *goja.Runtime) func(call goja.FunctionCall) goja.Value {
 }
 
 func handleJSONRPC(c *gin.Context) {
-	log.Print("handleJSONRPC called")
-	// 1) リクエストボディを読み込み、JSONRPCRequest にパース
+	// 1) リクエストボディを読み込み（nyanRequest 用に保持）、JSONRPCRequest にパース
+	if _, err := captureRequestBody(c, maxBodySize(EndpointConfig{})); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, JSONRPCResponse{
+				JSONRPC: "2.0",
+				Error: &JSONRPCError{
+					Code:    -32600,
+					Message: fmt.Sprintf("Invalid Request: body exceeds %d bytes", tooLarge.Limit),
+				},
+			})
+			return
+		}
+		respondJSONRPCError(c, nil, -32700, "Parse error", err.Error())
+		return
+	}
 	var rpcReq JSONRPCRequest
 	if err := c.ShouldBindJSON(&rpcReq); err != nil {
 		respondJSONRPCError(c, nil, -32700, "Parse error", err.Error())
@@ -1372,12 +5694,18 @@ func handleJSONRPC(c *gin.Context) {
 	}
 
 	// 3) api.json から、リクエストされたAPI設定を取得
-	config, exists := apiConfig[rpcReq.Method]
+	config, exists := currentAPIConfig()[rpcReq.Method]
 	if !exists {
 		respondJSONRPCError(c, rpcReq.ID, -32601, fmt.Sprintf("API not found: %s", rpcReq.Method), nil)
 		return
 	}
 
+	// JSON-RPC は POST で届くため、methods で POST を許可していない API は呼び出せない
+	if !isMethodAllowed(config, http.MethodPost) {
+		respondJSONRPCError(c, rpcReq.ID, -32601, fmt.Sprintf("API %s does not allow POST", rpcReq.Method), nil)
+		return
+	}
+
 	// 4) JSON-RPC では HTML 出力は想定しないため、script が必須とする
 	if config.Script == "" {
 		respondJSONRPCError(c, rpcReq.ID, -32603, "No script defined for JSON-RPC API", nil)
@@ -1393,28 +5721,31 @@ func handleJSONRPC(c *gin.Context) {
 		allParams[k] = v[0]
 	}
 
-	// 6) 実行ファイルのディレクトリを解決し、スクリプトのパスを決定
-	exePath, err := os.Executable()
-	if err != nil {
-		respondJSONRPCError(c, rpcReq.ID, -32603, "Failed to get executable path", err.Error())
-		return
-	}
-	exeDir := filepath.Dir(exePath)
-	scriptPath := resolvePath(exeDir, config.Script)
+	// 6) ベースディレクトリからスクリプトのパスを決定
+	scriptPath := resolvePath(baseDir, config.Script)
 	htmlPath := ""
 	if config.HTML != "" {
-		htmlPath = resolvePath(exeDir, config.HTML)
+		htmlPath = resolvePath(baseDir, config.HTML)
 	}
 
 	// 7) メインのスクリプト実行（runJavaScript は既存関数）
-	resultStr, err := runJavaScript(scriptPath, htmlPath, allParams)
+	c.Set(currentAPINameKey, rpcReq.Method)
+	setRequestLogger(c, endpointLogger(requestLogger(c), config.Name, config.LogLevel))
+	ctx, cancel := context.WithTimeout(c.Request.Context(), scriptTimeout(config))
+	defer cancel()
+	resultStr, err := runJavaScript(ctx, c, scriptPath, htmlPath, allParams)
 	if err != nil {
+		if isScriptTimeout(err) {
+			requestLogger(c).Warn("Script timed out", "timeout", scriptTimeout(config))
+			respondJSONRPCError(c, rpcReq.ID, -32603, "Script execution timed out", err.Error())
+			return
+		}
 		respondJSONRPCError(c, rpcReq.ID, -32603, "Script execution error", err.Error())
 		return
 	}
 
 	// 8) Push 処理（必要な場合）
-	performPush(config, allParams)
+	performPush(context.WithoutCancel(c.Request.Context()), config, allParams)
 
 	// 10) JSON-RPC 成功レスポンスを構築して返却
 	rpcResp := JSONRPCResponse{
@@ -1439,49 +5770,116 @@ func respondJSONRPCError(c *gin.Context, id interface{}, code int, message strin
 }
 
 // performPush は指定された config に対して push 処理を行います。
-func performPush(config EndpointConfig, allParams map[string]interface{}) {
+func performPush(ctx context.Context, config EndpointConfig, allParams map[string]interface{}) {
 	if config.Push == "" {
 		return
 	}
-	pushConfig, ok := apiConfig[config.Push]
+	logger := loggerFromContext(ctx).With("push", config.Push)
+	pushConfig, ok := currentAPIConfig()[config.Push]
 	if !ok {
-		log.Printf("Push target %s not found in apiConfig", config.Push)
-		return
-	}
-	exePath, err := os.Executable()
-	if err != nil {
-		log.Printf("Failed to get executable path for push: %v", err)
+		logger.Error("Push target not found in apiConfig")
 		return
 	}
-	exeDir := filepath.Dir(exePath)
-	scriptPath := resolvePath(exeDir, pushConfig.Script)
-	htmlPath := resolvePath(exeDir, pushConfig.HTML)
+	scriptPath := resolvePath(baseDir, pushConfig.Script)
+	htmlPath := resolvePath(baseDir, pushConfig.HTML)
 	var pushResult string
 	if pushConfig.Script == "" {
 		content, err := os.ReadFile(htmlPath)
 		if err != nil {
-			log.Printf("Failed to read push HTML file %s: %v", htmlPath, err)
+			logger.Error("Failed to read push HTML file", "path", htmlPath, "error", err)
 			return
 		}
 		pushResult = string(content)
 	} else {
-		result, err := runJavaScript(scriptPath, htmlPath, allParams)
+		ctx, cancel := context.WithTimeout(ctx, scriptTimeout(pushConfig))
+		defer cancel()
+		result, err := runJavaScript(ctx, nil, scriptPath, htmlPath, allParams)
 		if err != nil {
-			log.Printf("Failed to run push script: %v", err)
+			logger.Error("Failed to run push script", "error", err)
 			return
 		}
 		pushResult = result
 	}
 	if pushResult != "" {
-		wsConnections.RLock()
-		pushConns := wsConnections.conns[config.Push]
-		wsConnections.RUnlock()
-		for _, conn := range pushConns {
-			if err := conn.WriteMessage(websocket.TextMessage, []byte(pushResult)); err != nil {
-				log.Printf("Error pushing message to %s: %v", config.Push, err)
-			} else {
-				log.Printf("Push message sent to %s", config.Push)
+		pushMessage(logger, config.Push, websocket.TextMessage, []byte(pushResult), nil)
+	}
+}
+
+// pushMessage は channel（エンドポイント名）の WebSocket 接続のうち match に一致するもの（nil の場合はすべて）へ
+// メッセージを送信し、送信できた接続の数を返します。
+func pushMessage(logger *slog.Logger, channel string, messageType int, data []byte, match func(*wsConnection) bool) int {
+	addMetric("nyanpui_pushes_total", 1, channel)
+	delivered := 0
+	for _, wc := range webSocketConnections(channel) {
+		if match != nil && !match(wc) {
+			continue
+		}
+		if err := wc.write(messageType, data); err != nil {
+			logger.Error("Error pushing message", "connection_id", wc.id, "error", err)
+			addMetric("nyanpui_push_failures_total", 1, channel)
+			continue
+		}
+		delivered++
+		addMetric("nyanpui_push_messages_total", 1, channel)
+	}
+	logger.Debug("Push message sent", "channel", channel, "recipients", delivered)
+	return delivered
+}
+
+// newPushFilter は nyanPush の filter から送信先の判定関数を作ります。
+// 文字列の場合は接続 ID、オブジェクトの場合は ws_auth の identity の各キーの値がすべて一致する接続を対象にします。
+func newPushFilter(filter interface{}) (func(*wsConnection) bool, error) {
+	switch v := filter.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return func(wc *wsConnection) bool { return wc.id == v }, nil
+	case map[string]interface{}:
+		expected, _ := normalizeJSONValue(v).(map[string]interface{})
+		return func(wc *wsConnection) bool {
+			identity, ok := wc.identity.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			for key, value := range expected {
+				if !reflect.DeepEqual(identity[key], value) {
+					return false
+				}
 			}
+			return true
+		}, nil
+	}
+	return nil, fmt.Errorf("filter must be a connection ID or an object")
+}
+
+// pushPayload は nyanPush の message を送信するメッセージの種類とデータに変換します。
+// 文字列はテキスト、ArrayBuffer / Uint8Array はバイナリ、それ以外は JSON のテキストとして送信します。
+func pushPayload(value goja.Value) (int, []byte, error) {
+	switch v := value.Export().(type) {
+	case string:
+		return websocket.TextMessage, []byte(v), nil
+	case goja.ArrayBuffer:
+		return websocket.BinaryMessage, v.Bytes(), nil
+	case []byte:
+		return websocket.BinaryMessage, v, nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return 0, nil, err
 		}
+		return websocket.TextMessage, data, nil
+	}
+}
+
+// normalizeJSONValue は JSON に変換して戻すことで、数値などの型を JSON をデコードした値にそろえます。
+func normalizeJSONValue(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return value
 	}
+	return normalized
 }
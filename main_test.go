@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// setupTestBaseDir は scripts（ファイル名と内容）を書き込んだ一時ディレクトリをベースディレクトリにし、
+// ログを捨てるよう設定します。変更したグローバルな状態はテストの終了時に戻します。
+func setupTestBaseDir(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevBaseDir, prevAccessLog, prevLogger := baseDir, accessLogWriter, slog.Default()
+	prevConfig, prevAPI := currentConfig(), currentAPIConfig()
+	prevRouter := currentRouter.Load()
+	httpClients.RLock()
+	prevClients := httpClients.clients
+	httpClients.RUnlock()
+	baseDir = dir
+	accessLogWriter = io.Discard
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() {
+		baseDir, accessLogWriter = prevBaseDir, prevAccessLog
+		slog.SetDefault(prevLogger)
+		setCurrentConfigs(prevConfig, prevAPI)
+		currentRouter.Store(prevRouter)
+		setHTTPClients(prevClients)
+	})
+	return dir
+}
+
+// newTestRouter は config と api を現在の設定にしてルーターを作成します。
+func newTestRouter(t *testing.T, dir string, config Config, api APIConfig) *gin.Engine {
+	t.Helper()
+	setCurrentConfigs(config, api)
+	r, err := newRouter(dir, config, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// TestCookiesAreIsolatedPerRequest は並行するリクエストのスクリプトが
+// それぞれ自分のリクエストの Cookie を読み書きすることを確認します。
+func TestCookiesAreIsolatedPerRequest(t *testing.T) {
+	dir := setupTestBaseDir(t, map[string]string{
+		"cookie.js": `nyanSetCookie("echo", nyanGetCookie("id"));
+nyanGetCookie("id");`,
+	})
+	r := newTestRouter(t, dir, Config{}, APIConfig{"cookie": {Name: "cookie", Script: "./cookie.js"}})
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprintf("client-%d", i)
+			req := httptest.NewRequest(http.MethodGet, "/cookie", nil)
+			req.AddCookie(&http.Cookie{Name: "id", Value: want})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				errs <- fmt.Errorf("request %d: status %d: %s", i, w.Code, w.Body.String())
+				return
+			}
+			if got := w.Body.String(); got != want {
+				errs <- fmt.Errorf("request %d: body %q, want %q", i, got, want)
+				return
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != "echo" || cookies[0].Value != want {
+				errs <- fmt.Errorf("request %d: Set-Cookie %v, want echo=%s", i, cookies, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestMethodsRestrictRESTAndJSONRPC は methods で許可していないメソッドが
+// REST では 405、JSON-RPC（POST）ではエラーになることを確認します。
+func TestMethodsRestrictRESTAndJSONRPC(t *testing.T) {
+	dir := setupTestBaseDir(t, map[string]string{"ok.js": `"ok"`})
+	api := APIConfig{
+		"readonly": {Name: "readonly", Script: "./ok.js", Methods: []string{http.MethodGet}},
+		"writable": {Name: "writable", Script: "./ok.js", Methods: []string{http.MethodPost}},
+	}
+	r := newTestRouter(t, dir, Config{}, api)
+
+	tests := []struct {
+		method, path string
+		wantStatus   int
+		wantAllow    string
+	}{
+		{http.MethodGet, "/readonly", http.StatusOK, ""},
+		{http.MethodHead, "/readonly", http.StatusOK, ""},
+		{http.MethodPost, "/readonly", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodDelete, "/writable", http.StatusMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodPost, "/?api=readonly", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.wantStatus)
+		}
+		if got := w.Header().Get("Allow"); got != tt.wantAllow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.path, got, tt.wantAllow)
+		}
+	}
+
+	rpc := func(method string) JSONRPCResponse {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "method": %q, "id": 1}`, method)
+		req := httptest.NewRequest(http.MethodPost, "/nyan-rpc", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp JSONRPCResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: invalid JSON-RPC response %q: %v", method, w.Body.String(), err)
+		}
+		return resp
+	}
+	if resp := rpc("readonly"); resp.Error == nil || resp.Error.Code != -32601 {
+		t.Errorf("JSON-RPC readonly: got %+v, want error -32601", resp)
+	}
+	if resp := rpc("writable"); resp.Error != nil || resp.Result != "ok" {
+		t.Errorf("JSON-RPC writable: got %+v, want result ok", resp)
+	}
+}
+
+// TestWebSocketClientsStayStoppedAfterShutdown は終了処理で ws_client を停止した後の
+// 再読み込みで ws_client が起動しないことを確認します。
+func TestWebSocketClientsStayStoppedAfterShutdown(t *testing.T) {
+	setupTestBaseDir(t, map[string]string{"client.js": `""`})
+	t.Cleanup(func() {
+		wsClients.Lock()
+		wsClients.stopped = false
+		wsClients.Unlock()
+	})
+	api := APIConfig{"client": {Name: "client", Type: apiTypeWSClient, Script: "./client.js", ConnectURL: "ws://127.0.0.1:1/ws"}}
+
+	stopWebSocketClients()
+	if err := syncWebSocketClients(api); err != nil {
+		t.Fatal(err)
+	}
+	wsClients.Lock()
+	running := len(wsClients.running)
+	wsClients.Unlock()
+	if running != 0 {
+		t.Errorf("%d ws_client(s) started after shutdown, want 0", running)
+	}
+}
+
+// TestReloadRejectsInvalidConfig は検証でエラーになる api.json の再読み込みを拒否し、
+// 以前のルートで処理し続けることを確認します。
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	dir := setupTestBaseDir(t, map[string]string{
+		"hello.js":    `"hello"`,
+		"config.json": `{"port": 8009}`,
+		"api.json":    `{"hello": {"script": "./hello.js"}}`,
+	})
+	opts := cliOptions{configPath: filepath.Join(dir, "config.json"), apiPath: filepath.Join(dir, "api.json"), baseDir: dir}
+	if err := reloadConfigs(opts); err != nil {
+		t.Fatalf("initial reload: %v", err)
+	}
+
+	invalid := `{"broken": {"script": "./missing.js", "push": "nowhere"}}`
+	if err := os.WriteFile(opts.apiPath, []byte(invalid), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfigs(opts); err == nil {
+		t.Fatal("reload with a missing script succeeded, want an error")
+	}
+
+	if _, ok := currentAPIConfig()["broken"]; ok {
+		t.Error("invalid api.json replaced the current configuration")
+	}
+	w := httptest.NewRecorder()
+	serveCurrentRouter(w, httptest.NewRequest(http.MethodGet, "/hello", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("GET /hello after rejected reload: %d %q, want 200 \"hello\"", w.Code, w.Body.String())
+	}
+}
+
+// TestScriptReadRestriction は restrict_script_reads を指定した場合だけ
+// nyanGetFile がベースディレクトリと script_read_dirs の外を読めないことを確認します。
+func TestScriptReadRestriction(t *testing.T) {
+	outside := t.TempDir()
+	outsideFile := filepath.Join(outside, "outside.txt")
+	if err := os.WriteFile(outsideFile, []byte("outside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf(`var path = nyanAllParams.path === "outside" ? %q : "./inside.txt";
+try { nyanGetFile(path) } catch (e) { "error" }`, outsideFile)
+	dir := setupTestBaseDir(t, map[string]string{"read.js": script, "inside.txt": "inside"})
+	api := APIConfig{"read": {Name: "read", Script: "./read.js"}}
+
+	tests := []struct {
+		name   string
+		config Config
+		path   string
+		want   string
+	}{
+		{"default inside", Config{}, "inside", "inside"},
+		{"default outside", Config{}, "outside", "outside"},
+		{"restricted inside", Config{RestrictScriptReads: true}, "inside", "inside"},
+		{"restricted outside", Config{RestrictScriptReads: true}, "outside", "error"},
+		{"restricted read dir", Config{RestrictScriptReads: true, ScriptReadDirs: []string{outside}}, "outside", "outside"},
+	}
+	for _, tt := range tests {
+		r := newTestRouter(t, dir, tt.config, api)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/read?path="+tt.path, nil))
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestCloseWebSocketConnectionsSendsGoingAway は終了時にすべての WebSocket 接続へ
+// 1001 の close フレームを送り、切断を待って戻ることを確認します。
+func TestCloseWebSocketConnectionsSendsGoingAway(t *testing.T) {
+	dir := setupTestBaseDir(t, map[string]string{"ws.js": `"pong"`})
+	server := httptest.NewServer(newTestRouter(t, dir, Config{}, APIConfig{"ws": {Name: "ws", Script: "./ws.js"}}))
+	defer server.Close()
+
+	const n = 3
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	clients := make([]*websocket.Conn, n)
+	for i := range clients {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients[i] = conn
+	}
+	waitFor(t, func() bool { return len(webSocketConnectionList()) == n })
+
+	// クライアントは close フレームを受け取ると close フレームを返して切断する
+	codes := make(chan int, n)
+	for _, conn := range clients {
+		go func(conn *websocket.Conn) {
+			_, _, err := conn.ReadMessage()
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				codes <- closeErr.Code
+				return
+			}
+			codes <- -1
+		}(conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closeWebSocketConnections(ctx)
+	if ctx.Err() != nil {
+		t.Error("closeWebSocketConnections waited until the deadline")
+	}
+	for i := 0; i < n; i++ {
+		if code := <-codes; code != websocket.CloseGoingAway {
+			t.Errorf("close code %d, want %d", code, websocket.CloseGoingAway)
+		}
+	}
+	if remaining := len(webSocketConnectionList()); remaining != 0 {
+		t.Errorf("%d connection(s) still registered", remaining)
+	}
+}
+
+// waitFor は cond が true になるまで最大 2 秒待ちます。
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestCORSPreflightMethods はプリフライトの Access-Control-Allow-Methods が
+// エンドポイントの methods で受け付けるメソッドに絞られることを確認します。
+func TestCORSPreflightMethods(t *testing.T) {
+	dir := setupTestBaseDir(t, map[string]string{"ok.js": `"ok"`})
+	api := APIConfig{
+		"any":      {Name: "any", Script: "./ok.js"},
+		"readonly": {Name: "readonly", Script: "./ok.js", Methods: []string{http.MethodGet}},
+	}
+	r := newTestRouter(t, dir, Config{}, api)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/any", "POST, OPTIONS, GET, PUT, DELETE"},
+		{"/readonly", "OPTIONS, GET"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodOptions, tt.path, nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("OPTIONS %s: status %d, want 204", tt.path, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); got != tt.want {
+			t.Errorf("OPTIONS %s: Access-Control-Allow-Methods %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// TestWebSocketWriteAfterClose は閉じた接続への write が送信待ちに積まずにエラーを返すことを確認します。
+func TestWebSocketWriteAfterClose(t *testing.T) {
+	dir := setupTestBaseDir(t, map[string]string{"ws.js": `"pong"`})
+	server := httptest.NewServer(newTestRouter(t, dir, Config{}, APIConfig{"ws": {Name: "ws", Script: "./ws.js"}}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool { return len(webSocketConnectionList()) == 1 })
+	wc := webSocketConnectionList()[0]
+
+	wc.close()
+	for i := 0; i < 100; i++ {
+		if err := wc.write(websocket.TextMessage, []byte("late")); !errors.Is(err, errWebSocketClosed) {
+			t.Fatalf("write %d after close: %v, want errWebSocketClosed", i, err)
+		}
+	}
+	if queued := len(wc.send); queued != 0 {
+		t.Errorf("%d message(s) queued after close", queued)
+	}
+}
+
+// TestLegacyGetAPIArgs は nyanGetAPI の以前の (url, user, pass) の形が Basic 認証として扱われることを確認します。
+func TestLegacyGetAPIArgs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		fmt.Fprintf(w, "%s:%s?%s", user, pass, r.URL.RawQuery)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name string
+		call string
+		want string
+	}{
+		{"legacy", `nyanGetAPI(url, "user", "pass")`, "user:pass?"},
+		{"legacy empty auth", `nyanGetAPI(url, "", "")`, ":?"},
+		{"query and auth", `nyanGetAPI(url, "a=1", "user", "pass")`, "user:pass?a=1"},
+		{"query object", `nyanGetAPI(url, {"a": "1"})`, ":?a=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupTestBaseDir(t, map[string]string{
+				"get.js": fmt.Sprintf("const url = %q;\n%s;", upstream.URL, tt.call),
+			})
+			clients, err := newHTTPClients(dir, HTTPClientConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			setHTTPClients(clients)
+			r := newTestRouter(t, dir, Config{}, APIConfig{"get": {Name: "get", Script: "./get.js"}})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHostExecAllowedCommands は host_exec の allowed_commands と enabled で
+// nyanHostExec が実行できるコマンドが制限されることを確認します。
+func TestHostExecAllowedCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses echo, true and sh")
+	}
+	dir := setupTestBaseDir(t, map[string]string{
+		"exec.js": `function run(command) {
+  try { return nyanHostExec(command).stdout.trim(); } catch (e) { return "denied"; }
+}
+[run(["echo", "argv"]), run(["true"]), run("echo shell")].join(",");`,
+	})
+	api := APIConfig{"exec": {Name: "exec", Script: "./exec.js"}}
+	disabled := false
+
+	tests := []struct {
+		name   string
+		config HostExecConfig
+		want   string
+	}{
+		{"no allowlist", HostExecConfig{}, "argv,,shell"},
+		{"argv only", HostExecConfig{AllowedCommands: []string{"echo"}}, "argv,denied,denied"},
+		{"with shell", HostExecConfig{AllowedCommands: []string{"echo", "sh"}}, "argv,denied,shell"},
+		{"disabled", HostExecConfig{Enabled: &disabled, AllowedCommands: []string{"echo"}}, "denied,denied,denied"},
+	}
+	for _, tt := range tests {
+		r := newTestRouter(t, dir, Config{HostExec: tt.config}, api)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/exec", nil))
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestScriptTimeout は script_timeout を過ぎたスクリプトが中断され 504 を返すことを確認します。
+func TestScriptTimeout(t *testing.T) {
+	dir := setupTestBaseDir(t, map[string]string{"loop.js": `while (true) {}`})
+	r := newTestRouter(t, dir, Config{ScriptTimeout: 1}, APIConfig{"loop": {Name: "loop", Script: "./loop.js"}})
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/loop", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504: %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("script ran for %v, want about 1s", elapsed)
+	}
+}
+
+// TestCircuitBreakerStopsRequests は失敗が failure_threshold 回続いたホストへの
+// リクエストが送られなくなることを確認します。
+func TestCircuitBreakerStopsRequests(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	dir := setupTestBaseDir(t, map[string]string{
+		"get.js": fmt.Sprintf("for (let i = 0; i < 5; i++) { nyanGetAPI(%q); }\n\"done\";", upstream.URL),
+	})
+	cfg := HTTPClientConfig{HTTPClientProfile: HTTPClientProfile{
+		CircuitBreaker: &CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: 60},
+	}}
+	clients, err := newHTTPClients(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setHTTPClients(clients)
+	r := newTestRouter(t, dir, Config{HTTPClient: cfg}, APIConfig{"get": {Name: "get", Script: "./get.js"}})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits != 2 {
+		t.Errorf("upstream received %d requests, want 2", hits)
+	}
+}